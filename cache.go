@@ -1,12 +1,16 @@
 package httpc
 
 import (
-	"bytes"
+	"fmt"
 	"http"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -14,18 +18,43 @@ const (
 	stale
 )
 
-func normURL(url string) string {
-	u, err := http.ParseURL(url)
-	if err != nil {
-		return url // This is a cheap hack
-	}
-	u.Scheme = strings.ToLower(u.Scheme)
-	u.Host = strings.ToLower(u.Host)
-	if u.Path == "" {
-		u.Path = "/"
-	}
-	return u.String()
-}
+// Keys in a stored info map that are bookkeeping for the cache rather than
+// response headers. Canonical header keys never start with a lower case
+// letter, so these can't collide with a real header.
+const (
+	infoPrefix       = "httpc."
+	infoRequestTime  = "httpc.request-time"
+	infoResponseTime = "httpc.response-time"
+
+	// The status line of the stored response.
+	infoStatus     = "httpc.status"
+	infoStatusCode = "httpc.status-code"
+	infoProto      = "httpc.proto"
+
+	// Marks an entry that only lists the request headers the stored
+	// variants of a response vary on. The variants live under secondary
+	// keys; see variantKey.
+	infoVary = "httpc.vary"
+
+	// Prefixes the name of each request header a variant was selected by;
+	// the value is what the request that fetched it sent.
+	infoVaryPrefix = "httpc.vary."
+
+	// Followed by 0, 1, 2 and so on, lists the secondary keys of the
+	// variants in a marker entry, oldest first, each quoted as by
+	// strconv.Quote, so that they can be deleted with the marker.
+	infoVariantPrefix = "httpc.variant."
+)
+
+// The most variants of one response kept at a time. Storing another evicts
+// the oldest.
+const maxVariants = 32
+
+// The layout of an IMF-fixdate, the preferred form of HTTP-date.
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Returns the current time in seconds since the epoch. Tests replace it.
+var now = time.Seconds
 
 // When implementing this interface, let errors silently fail, as if the entry
 // in question never existed.
@@ -33,28 +62,172 @@ type Store interface {
 	Set(key string, info map[string]string, content []byte)
 	Get(key string) (info map[string]string, content io.ReadCloser)
 	Delete(key string)
+
+	// Begins storing an entry whose content is written bit by bit, as it
+	// arrives. The entry replaces any other under key only once the
+	// writer is committed.
+	Create(key string, info map[string]string) StoreWriter
+}
+
+// Writes the content of a new store entry. When done, call Commit to store
+// the entry, or Abort to throw it away. If the store can't take any more,
+// Write returns an error, and the entry will not be stored.
+type StoreWriter interface {
+	io.Writer
+	Commit()
+	Abort()
 }
 
 type cache struct {
 	store Store
-    next Sender
+	next  Sender
+	opts  CacheOptions
+
+	// Fetches from the origin in progress, by key.
+	flights *flightGroup
+
+	// Held while a marker entry is read and written back, so that
+	// concurrent updates don't lose each other's variants.
+	markers *sync.Mutex
+}
+
+// Returns the key to store the response to req under. Requests with an
+// empty key are not cached.
+func (c cache) key(req *http.Request) string {
+	if c.opts.Key != nil {
+		return c.opts.Key(req)
+	}
+	return NormalizeURL(req.RawURL, c.opts.SortQuery)
+}
+
+// Settings for a cache made by NewCacheWithOptions. The zero value gives a
+// cache like NewCache does.
+type CacheOptions struct {
+	// How many seconds past its freshness lifetime a stored response may
+	// still be served if the next Sender fails or answers with a server
+	// error, unless the response says otherwise with stale-if-error.
+	StaleIfError int64
+
+	// Computes the key a request's response is stored under. Two requests
+	// with the same key get the same stored response, unless it varies
+	// on their headers. If Key returns the empty string, the request
+	// bypasses the cache. If nil, responses are keyed by NormalizeURL.
+	Key func(req *http.Request) string
+
+	// Makes the default key ignore the order of query parameters.
+	SortQuery bool
+
+	// The largest response body, in bytes, that will be stored. Bigger
+	// ones pass through without being stored. If zero, there is no limit
+	// other than what the Store can hold.
+	MaxObjectSize int64
 }
 
 // A Cache forwards requests to the next Sender and caches responses in its
 // Store according to the rules of HTTP.
 func NewCache(store Store, next Sender) Sender {
-	return cache{store, next}
+	return NewCacheWithOptions(store, next, CacheOptions{})
 }
 
-var ignoreHeaders = map[string]bool {
-	"Content-Encoding": true,
-	"Transfer-Encoding": true,
+// Like NewCache, but with settings.
+func NewCacheWithOptions(store Store, next Sender, opts CacheOptions) Sender {
+	return cache{store, next, opts, &flightGroup{m: map[string]*flight{}}, new(sync.Mutex)}
 }
 
-func (c cache) updateStore(key string, body []byte, req *http.Request, resp *http.Response) {
-	if key == "" {
+// How long, in nanoseconds, a request waits for another's fetch of the same
+// key before giving up and making its own. The fetch isn't over until its
+// response has been stored, which takes reading the body. That might never
+// happen, or might be waiting on this very request, so a request that gives
+// up takes the fetch over, and later ones wait for it instead. Tests change
+// it.
+var maxCollapseWait int64 = 10e9
+
+// A fetch from the origin that other requests for the same key can wait for
+// instead of making their own.
+type flight struct {
+	done chan bool // closed once the response is stored, or won't be
+}
+
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flight
+}
+
+// Returns the flight in progress for key. If there is none, this starts one
+// and returns leader == true; the caller must land it.
+func (g *flightGroup) join(key string) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.m[key]; ok {
+		return f, false
+	}
+	f = &flight{make(chan bool)}
+	g.m[key] = f
+	return f, true
+}
+
+// Replaces f, the flight in progress for key, by one the caller leads. If f
+// has landed or been replaced already, this returns leader == false.
+func (g *flightGroup) takeOver(key string, f *flight) (nf *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.m[key] != f {
+		return f, false
+	}
+	nf = &flight{make(chan bool)}
+	g.m[key] = nf
+	return nf, true
+}
+
+// Ends a flight, releasing everyone waiting for it.
+func (g *flightGroup) land(key string, f *flight) {
+	g.mu.Lock()
+	if g.m[key] == f {
+		g.m[key] = nil, false
+	}
+	g.mu.Unlock()
+	close(f.done)
+}
+
+// Lands f once resp, the leader's response, has been stored or has failed to
+// be. That happens as the body is read, so waiters wait for that too.
+func (c cache) landAfter(key string, f *flight, resp *http.Response, err os.Error, status *CacheStatus) {
+	t, ok := resp.Body.(*tee)
+	if err != nil || !status.Stored || !ok || t.w == nil {
+		c.flights.land(key, f)
 		return
 	}
+	t.w = &landingWriter{w: t.w, land: func() { c.flights.land(key, f) }}
+}
+
+// Calls land once the entry is committed or aborted.
+type landingWriter struct {
+	w    StoreWriter
+	land func()
+}
+
+func (lw *landingWriter) Write(p []byte) (int, os.Error) { return lw.w.Write(p) }
+
+func (lw *landingWriter) Commit() {
+	lw.w.Commit()
+	lw.land()
+}
+
+func (lw *landingWriter) Abort() {
+	lw.w.Abort()
+	lw.land()
+}
+
+// Headers that describe the message as it was sent, rather than the stored
+// representation. Content-Encoding is not among them: the content is stored
+// as it came, encoded or not, and the header has to stay with it.
+var ignoreHeaders = map[string]bool {
+	"Transfer-Encoding": true,
+}
+
+// Returns the info to store for resp: its header and status line, and when
+// it was fetched.
+func responseInfo(resp *http.Response, requestTime, responseTime int64) map[string]string {
 	info := map[string]string{}
 	for k, v := range resp.Header {
 		if _, ok := ignoreHeaders[k]; !ok {
@@ -62,24 +235,347 @@ func (c cache) updateStore(key string, body []byte, req *http.Request, resp *htt
 		}
 	}
 
-	// TODO deal with Vary header
+	info[infoStatus] = resp.Status
+	info[infoStatusCode] = strconv.Itoa(resp.StatusCode)
+	info[infoProto] = resp.Proto
+	info[infoRequestTime] = strconv.Itoa64(requestTime)
+	info[infoResponseTime] = strconv.Itoa64(responseTime)
+	return info
+}
+
+// Returns the canonical names of the request headers listed in a Vary header,
+// sorted. Returns nil if the response varies on something other than request
+// headers ("*").
+func varyNames(vary string) []string {
+	names := splitList(vary)
+	for i, name := range names {
+		if name == "*" {
+			return nil
+		}
+		names[i] = http.CanonicalHeaderKey(name)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+// Reports whether names lists the header name, in any case.
+func hasName(names []string, name string) bool {
+	for _, x := range names {
+		if http.CanonicalHeaderKey(x) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the secondary key for the variant of the response stored under key
+// that a request with the given header selects.
+func variantKey(key string, names []string, header map[string]string) string {
+	for _, name := range names {
+		key += "\n" + name + ": " + strings.TrimSpace(header[name])
+	}
+	return key
+}
+
+// Begins storing an entry under key. If the response varies on request
+// headers, the entry goes under a secondary key instead, and key gets a
+// marker listing the headers and the variants, so that several variants can
+// be stored side by side. Returns nil if the response can't be stored, in
+// which case any response stored under key before is deleted.
+func (c cache) createEntry(key string, info map[string]string, req *http.Request) StoreWriter {
+	c.markers.Lock()
+	defer c.markers.Unlock()
+	marker, content := c.store.Get(key)
+	if content != nil {
+		content.Close()
+	}
+	old := variantKeys(marker)
+
+	// The client decodes responses unless the request asked for codings
+	// of its own, so an encoded response is only for requests that accept
+	// its coding, whether or not the origin says it varies on that.
+	vary, ok := info["Vary"]
+	if coding := info["Content-Encoding"]; coding != "" && coding != "identity" && !hasName(splitList(vary), "Accept-Encoding") {
+		vary, ok = joinList(vary, "Accept-Encoding"), true
+	}
+	if !ok {
+		c.deleteVariants(old)
+		return c.store.Create(key, info)
+	}
+	names := varyNames(vary)
+	if names == nil {
+		// Vary: * matches no later request, and the response stored
+		// before is outdated.
+		c.deleteVariants(old)
+		c.store.Delete(key)
+		return nil
+	}
+	for _, name := range names {
+		info[infoVaryPrefix+name] = strings.TrimSpace(req.Header[name])
+	}
+
+	vary = strings.Join(names, ", ")
+	if marker[infoVary] != vary {
+		c.deleteVariants(old)
+		old = nil
+	}
+	vkey := variantKey(key, names, req.Header)
+	keys := make([]string, 0, len(old)+1)
+	for _, k := range old {
+		if k != vkey {
+			keys = keys[0 : len(keys)+1]
+			keys[len(keys)-1] = k
+		}
+	}
+	keys = keys[0 : len(keys)+1]
+	keys[len(keys)-1] = vkey
+	if len(keys) > maxVariants {
+		c.deleteVariants(keys[0 : len(keys)-maxVariants])
+		keys = keys[len(keys)-maxVariants:]
+	}
+	marker = map[string]string{infoVary: vary}
+	for i, k := range keys {
+		marker[infoVariantPrefix+strconv.Itoa(i)] = strconv.Quote(k)
+	}
+	c.store.Set(key, marker, nil)
+	return c.store.Create(vkey, info)
+}
+
+// Returns the secondary keys of the variants listed in a marker entry,
+// oldest first, or nil if info isn't a marker.
+func variantKeys(info map[string]string) []string {
+	var keys []string
+	for i := 0; ; i++ {
+		v, ok := info[infoVariantPrefix+strconv.Itoa(i)]
+		if !ok {
+			return keys
+		}
+		if keys == nil {
+			keys = make([]string, 0, maxVariants)
+		}
+		if k, err := strconv.Unquote(v); err == nil && len(keys) < cap(keys) {
+			keys = keys[0 : len(keys)+1]
+			keys[len(keys)-1] = k
+		}
+	}
+	panic("can not happen")
+}
+
+func (c cache) deleteVariants(keys []string) {
+	for _, k := range keys {
+		c.store.Delete(k)
+	}
+}
 
-	info["Status"] = resp.Status
-	c.store.Set(key, info, body)
+// Finds the stored entry for req. If the response stored under key varies,
+// this looks up the variant that req selects, as long as the marker still
+// lists it; one that isn't listed may have outlived an invalidation.
+func (c cache) lookup(key string, req *http.Request) (map[string]string, io.ReadCloser) {
+	info, content := c.store.Get(key)
+	if info == nil {
+		return nil, nil
+	}
+	vary, ok := info[infoVary]
+	if !ok {
+		return info, content
+	}
+	content.Close()
+
+	vkey := variantKey(key, splitList(vary), req.Header)
+	listed := false
+	for _, k := range variantKeys(info) {
+		listed = listed || k == vkey
+	}
+	if !listed {
+		return nil, nil
+	}
+	info, content = c.store.Get(vkey)
+	if info == nil {
+		return nil, nil
+	}
+	for k, v := range info {
+		if strings.HasPrefix(k, infoVaryPrefix) && strings.TrimSpace(req.Header[k[len(infoVaryPrefix):]]) != v {
+			content.Close()
+			return nil, nil
+		}
+	}
+	return info, content
 }
 
-func (c cache) sendAndUpdate(req *http.Request, key string) (*http.Response, os.Error) {
+func (c cache) sendAndUpdate(req *http.Request, key string, status *CacheStatus) (*http.Response, os.Error) {
+	requestTime := now()
 	resp, err := c.next.Send(req)
 	if err != nil {
 		return resp, err
 	}
-	t := &tee{resp.Body, bytes.NewBuffer([]byte{}), false, func(t *tee) {
-		c.updateStore(key, t.buf.Bytes(), req, resp)
-	}}
-	resp.Body = t
+	status.FwdStatus = resp.StatusCode
+	c.teeToStore(key, req, resp, requestTime, now(), status)
 	return resp, err
 }
 
+// Status codes that can be stored without explicit freshness information
+// (RFC 9110, section 15.1). We leave out 206 because the cache does not
+// combine partial content.
+var heuristicallyCacheable = map[int]bool{
+	200: true,
+	203: true,
+	204: true,
+	300: true,
+	301: true,
+	308: true,
+	404: true,
+	405: true,
+	410: true,
+	414: true,
+	501: true,
+}
+
+// Reports whether resp, the response to req, may be stored (RFC 9111,
+// section 3). A cache may be shared by every goroutine in the process, as
+// DefaultSender is, so it follows the rules for shared caches.
+func cacheable(req *http.Request, resp *http.Response) bool {
+	if valueOrDefault(req.Method, "GET") != "GET" || resp.StatusCode < 200 || resp.StatusCode == 206 || resp.StatusCode == 304 {
+		return false
+	}
+	if _, ok := parseCacheControl(req.Header["Cache-Control"])["no-store"]; ok {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header["Cache-Control"])
+	_, noStore := cc["no-store"]
+	_, private := cc["private"]
+	if noStore || private {
+		return false
+	}
+	_, public := cc["public"]
+	_, mustRevalidate := cc["must-revalidate"]
+	_, sMaxAge := cc["s-maxage"]
+	if _, ok := req.Header["Authorization"]; ok && !public && !mustRevalidate && !sMaxAge {
+		return false
+	}
+
+	_, maxAge := cc["max-age"]
+	_, expires := resp.Header["Expires"]
+	return public || maxAge || sMaxAge || expires || heuristicallyCacheable[resp.StatusCode]
+}
+
+// Reports whether a stored response must not be served without first being
+// validated with the origin, once it is stale or at all.
+func mustRevalidate(info map[string]string) bool {
+	cc := parseCacheControl(info["Cache-Control"])
+	_, must := cc["must-revalidate"]
+	_, proxy := cc["proxy-revalidate"]
+	_, noCache := cc["no-cache"]
+	return must || proxy || noCache
+}
+
+// Arranges for resp to be stored under key once its body has been read, if
+// it is cacheable.
+func (c cache) teeToStore(key string, req *http.Request, resp *http.Response, requestTime, responseTime int64, status *CacheStatus) {
+	if key == "" || !cacheable(req, resp) {
+		return
+	}
+	if max := c.opts.MaxObjectSize; max > 0 && resp.ContentLength > max {
+		return
+	}
+	w := c.createEntry(key, responseInfo(resp, requestTime, responseTime), req)
+	if w == nil {
+		return
+	}
+	resp.Body = &tee{rc: resp.Body, w: w, max: c.opts.MaxObjectSize}
+	status.Stored = true
+}
+
+// Returns a copy of req with its own header map.
+func copyRequest(req *http.Request) *http.Request {
+	creq := new(http.Request)
+	*creq = *req
+	creq.Header = map[string]string{}
+	for k, v := range req.Header {
+		creq.Header[k] = v
+	}
+	return creq
+}
+
+// Returns a copy of req that asks the origin to validate a stored response,
+// or nil if the stored response has no validators.
+func conditionalRequest(req *http.Request, info map[string]string) *http.Request {
+	etag, lastModified := info["Etag"], info["Last-Modified"]
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	creq := copyRequest(req)
+	if _, ok := creq.Header["If-None-Match"]; !ok && etag != "" {
+		creq.Header["If-None-Match"] = etag
+	}
+	if _, ok := creq.Header["If-Modified-Since"]; !ok && lastModified != "" {
+		creq.Header["If-Modified-Since"] = lastModified
+	}
+	return creq
+}
+
+// Validates a stale entry with the origin. If the origin says it hasn't
+// changed, the stored entry is refreshed and served; otherwise the origin's
+// response replaces it. If the origin fails, the stale entry may be served
+// anyway; see staleIfError.
+func (c cache) revalidate(req *http.Request, key string, info map[string]string, content io.ReadCloser, status *CacheStatus) (*http.Response, os.Error) {
+	status.Fwd = "stale"
+	if freshnessLifetime(info) > currentAge(info) {
+		status.Fwd = "request"
+	}
+	creq := conditionalRequest(req, info)
+	if creq == nil {
+		// Nothing to validate with, so this is a plain fetch.
+		creq = req
+	}
+
+	requestTime := now()
+	resp, err := c.next.Send(creq)
+	if (err != nil || resp.StatusCode >= 500) && c.staleIfError(info, req.Header) {
+		if err == nil {
+			status.FwdStatus = resp.StatusCode
+			resp.Body.Close()
+		}
+		status.Detail = "stale-if-error"
+		response := cachedResponse(req, info, content)
+		response.Header["Warning"] = joinList(response.Header["Warning"], `111 - "Revalidation Failed"`)
+		return response, nil
+	}
+	if err != nil {
+		content.Close()
+		return nil, err
+	}
+	responseTime := now()
+	status.FwdStatus = resp.StatusCode
+	if resp.StatusCode != 304 {
+		content.Close()
+		c.teeToStore(key, req, resp, requestTime, responseTime, status)
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	// Headers in a 304 replace the stored ones (RFC 9111, section 4.3.4).
+	// The stored content is copied to the refreshed entry as it is served.
+	merged := map[string]string{}
+	for k, v := range info {
+		merged[k] = v
+	}
+	for k, v := range resp.Header {
+		// The stored content keeps its length and coding.
+		if _, ok := ignoreHeaders[k]; !ok && k != "Content-Length" && k != "Content-Encoding" {
+			merged[k] = v
+		}
+	}
+	merged[infoRequestTime] = strconv.Itoa64(requestTime)
+	merged[infoResponseTime] = strconv.Itoa64(responseTime)
+	response := cachedResponse(req, merged, content)
+	if w := c.createEntry(key, merged, req); w != nil {
+		response.Body = &tee{rc: content, w: w}
+		status.Stored = true
+	}
+	return response, nil
+}
+
 func valueOrDefault(value, def string) string {
 	if value == "" {
 		return def
@@ -87,87 +583,463 @@ func valueOrDefault(value, def string) string {
 	return value
 }
 
-func (c cache) Send(req *http.Request) (resp *http.Response, err os.Error) {
-	method := valueOrDefault(req.Method, "GET")
-	key := normURL(req.RawURL)
-	info, content := c.store.Get(key)
-	if info != nil {
-		state := state(info, req.Header)
-		if state == fresh {
-			response := cacheResponse(info)
-			response.Body = content
-			response.AddHeader("Via", "1.1 internal (httpc.go)")
-			response.Status = info["Status"]
-			statusCode, ok := info["StatusCode"]
-			if !ok {
-				statusCode = "200"
+func (c cache) Send(req *http.Request) (*http.Response, os.Error) {
+	status := new(CacheStatus)
+	resp, err := c.send(req, status)
+	if resp != nil {
+		if resp.Header == nil {
+			resp.Header = map[string]string{}
+		}
+		resp.Header["Cache-Status"] = joinList(resp.Header["Cache-Status"], status.String())
+	}
+	return resp, err
+}
+
+func (c cache) send(req *http.Request, status *CacheStatus) (resp *http.Response, err os.Error) {
+	if method := valueOrDefault(req.Method, "GET"); method != "GET" {
+		status.Fwd = "method"
+		resp, err = c.next.Send(req)
+		if err == nil {
+			status.FwdStatus = resp.StatusCode
+			if !safeMethods[method] && resp.StatusCode >= 200 && resp.StatusCode < 400 {
+				c.invalidate(req, resp)
 			}
-			response.StatusCode, err = strconv.Atoi(statusCode)
-			if err != nil {
-				err = nil
-				response.StatusCode = 200
+		}
+		return
+	}
+	cc := parseCacheControl(req.Header["Cache-Control"])
+	if _, ok := cc["no-store"]; ok {
+		status.Fwd = "request"
+		resp, err = c.next.Send(req)
+		if err == nil {
+			status.FwdStatus = resp.StatusCode
+		}
+		return
+	}
+	_, onlyIfCached := cc["only-if-cached"]
+
+	key := c.key(req)
+	if key == "" {
+		status.Fwd = "bypass"
+		resp, err = c.next.Send(req)
+		if err == nil {
+			status.FwdStatus = resp.StatusCode
+		}
+		return
+	}
+	info, content := c.lookup(key, req)
+	if info == nil && onlyIfCached {
+		status.Detail = "only-if-cached"
+		return gatewayTimeout(req), nil
+	}
+	if info != nil {
+		if state(info, req.Header) == fresh {
+			return hit(req, info, content, status), nil
+		}
+		if !onlyIfCached && staleWhileRevalidate(info, req.Header) {
+			c.refresh(req, key)
+			status.Detail = "stale-while-revalidate"
+			return hit(req, info, content, status), nil
+		}
+		if onlyIfCached {
+			if mustRevalidate(info) {
+				content.Close()
+				status.Detail = "only-if-cached"
+				return gatewayTimeout(req), nil
 			}
-			return response, nil
+			return hit(req, info, content, status), nil
 		}
+	}
 
-		if state == stale {
-			// TODO modify request headers
-			return nil, os.NewError("not implemented")
+	// We have to ask the origin. If another request for the same key
+	// already is, wait for its response to be stored and use that if we
+	// can.
+	f, leader := c.flights.join(key)
+	if !leader {
+		if content != nil {
+			content.Close()
+		}
+		select {
+		case <-f.done:
+		case <-time.After(maxCollapseWait):
+			f, leader = c.flights.takeOver(key, f)
+		}
+		info, content = c.lookup(key, req)
+		if info != nil && state(info, req.Header) == fresh {
+			if leader {
+				c.flights.land(key, f)
+			}
+			status.Detail = "collapsed"
+			return hit(req, info, content, status), nil
 		}
+	}
+
+	if info == nil {
+		status.Fwd = "uri-miss"
+		resp, err = c.sendAndUpdate(req, key, status)
+	} else {
+		resp, err = c.revalidate(req, key, info, content, status)
+	}
+	if leader {
+		c.landAfter(key, f, resp, err, status)
+	}
+	return
+}
+
+// Serves a stored entry without contacting the origin.
+func hit(req *http.Request, info map[string]string, content io.ReadCloser, status *CacheStatus) *http.Response {
+	status.Hit = true
+	status.TTL = freshnessLifetime(info) - currentAge(info)
+	return cachedResponse(req, info, content)
+}
+
+// Reports whether a stale entry may be served while it is revalidated in the
+// background (RFC 5861, section 3). A request that insists on a validated
+// response doesn't get one that way.
+func staleWhileRevalidate(info, header map[string]string) bool {
+	if mustRevalidate(info) {
+		return false
+	}
+	cc := parseCacheControl(header["Cache-Control"])
+	_, noCache := cc["no-cache"]
+	_, maxAge := cc["max-age"]
+	_, pragma := parseCacheControl(header["Pragma"])["no-cache"]
+	if noCache || maxAge || pragma {
+		return false
+	}
+	v, ok := parseCacheControl(info["Cache-Control"])["stale-while-revalidate"]
+	if !ok {
+		return false
+	}
+	window, _ := parseSeconds(v)
+	return currentAge(info)-freshnessLifetime(info) <= window
+}
+
+// Reports whether a stale entry may be served because the origin could not
+// be reached or answered with a server error (RFC 5861, section 4). Without
+// a stale-if-error directive in the response or request, the cache's
+// StaleIfError option gives the allowed staleness.
+func (c cache) staleIfError(info, header map[string]string) bool {
+	if mustRevalidate(info) {
+		return false
+	}
+	grace := c.opts.StaleIfError
+	if v, ok := parseCacheControl(info["Cache-Control"])["stale-if-error"]; ok {
+		grace, _ = parseSeconds(v)
+	}
+	if v, ok := parseCacheControl(header["Cache-Control"])["stale-if-error"]; ok {
+		grace, _ = parseSeconds(v)
+	}
+	return grace > 0 && currentAge(info)-freshnessLifetime(info) <= grace
+}
 
-		return nil, os.NewError("stub")
-		resp, err = c.sendAndUpdate(req, key)
+// Revalidates the entry for req in the background, unless the origin is
+// already being asked for it. Meanwhile everyone is served the stale entry.
+func (c cache) refresh(req *http.Request, key string) {
+	f, leader := c.flights.join(key)
+	if !leader {
+		return
+	}
+	req = copyRequest(req)
+	go func() {
+		status := new(CacheStatus)
+		info, content := c.lookup(key, req)
+		if info == nil {
+			c.flights.land(key, f)
+			return
+		}
+		resp, err := c.revalidate(req, key, info, content, status)
+		c.landAfter(key, f, resp, err, status)
 		if err != nil {
 			return
 		}
+		// Reading the body is what stores it.
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}()
+}
 
-		if resp.StatusCode == 304 && method == "GET" {
-			return nil, os.NewError("not implemented")
-		} else if resp.StatusCode == 200 {
-		} else {
-			return nil, os.NewError("not implemented")
+// Methods that don't change anything on the origin.
+var safeMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+}
+
+// Removes the stored responses that a successful unsafe request may have
+// changed (RFC 9111, section 4.4). Location and Content-Location targets are
+// only removed if they share the request's origin, so that one server can't
+// knock another's responses out of the cache.
+func (c cache) invalidate(req *http.Request, resp *http.Response) {
+	c.deleteKey(&http.Request{RawURL: req.RawURL, Header: req.Header})
+	for _, name := range []string{"Location", "Content-Location"} {
+		v, ok := resp.Header[name]
+		if !ok {
+			continue
+		}
+		if url := resolveURL(req.RawURL, v); urlOrigin(url) == urlOrigin(req.RawURL) {
+			c.deleteKey(&http.Request{RawURL: url, Header: req.Header})
 		}
-	} else {
-		resp, err = c.sendAndUpdate(req, key)
 	}
+}
 
-	return
+// Deletes the stored response to a GET like req, with all its variants.
+func (c cache) deleteKey(req *http.Request) {
+	key := c.key(req)
+	if key == "" {
+		return
+	}
+	c.markers.Lock()
+	defer c.markers.Unlock()
+	info, content := c.store.Get(key)
+	if content != nil {
+		content.Close()
+	}
+	c.deleteVariants(variantKeys(info))
+	c.store.Delete(key)
+}
+
+// The response to an only-if-cached request that the cache can't satisfy
+// (RFC 9111, section 5.2.1.7).
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     "504 Gateway Timeout",
+		StatusCode: 504,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     map[string]string{},
+		Body:       &stringReadCloser{[]byte{}, 0},
+		Request:    req,
+	}
+}
+
+// Builds a response to req from a stored entry.
+func cachedResponse(req *http.Request, info map[string]string, content io.ReadCloser) *http.Response {
+	response := cacheResponse(info)
+	response.Request = req
+	response.Body = content
+
+	var err os.Error
+	response.StatusCode, err = strconv.Atoi(info[infoStatusCode])
+	if err != nil {
+		response.StatusCode = 200
+	}
+	response.Status = valueOrDefault(info[infoStatus], strconv.Itoa(response.StatusCode))
+	response.Proto = valueOrDefault(info[infoProto], "HTTP/1.1")
+	if _, err = fmt.Sscanf(response.Proto, "HTTP/%d.%d", &response.ProtoMajor, &response.ProtoMinor); err != nil {
+		response.Proto, response.ProtoMajor, response.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	response.ContentLength = -1
+	if n, err := strconv.Atoi64(info["Content-Length"]); err == nil {
+		response.ContentLength = n
+	}
+
+	age := currentAge(info)
+	response.Header["Age"] = strconv.Itoa64(age)
+	if freshnessLifetime(info) <= age {
+		response.Header["Warning"] = `110 - "Response is Stale"`
+	}
+	return response
 }
 
 func cacheResponse(info map[string]string) *http.Response {
 	hr := &http.Response{}
-	hr.Header = info
+	hr.Header = map[string]string{}
+	for k, v := range info {
+		if !strings.HasPrefix(k, infoPrefix) {
+			hr.Header[k] = v
+		}
+	}
 	return hr
 }
 
+// Decides whether a stored response can be served without contacting the
+// origin, taking into account the request's Cache-Control directives (RFC
+// 9111, section 5.2.1).
 func state(info, header map[string]string) int {
-	return fresh
+	if _, ok := parseCacheControl(info["Cache-Control"])["no-cache"]; ok {
+		return stale
+	}
+	cc := parseCacheControl(header["Cache-Control"])
+	if _, ok := header["Cache-Control"]; !ok {
+		cc = parseCacheControl(header["Pragma"])
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return stale
+	}
+
+	lifetime, age := freshnessLifetime(info), currentAge(info)
+	if v, ok := cc["max-age"]; ok {
+		if maxAge, _ := parseSeconds(v); age > maxAge {
+			return stale
+		}
+	}
+	if v, ok := cc["min-fresh"]; ok {
+		minFresh, _ := parseSeconds(v)
+		age += minFresh
+	}
+	if lifetime > age {
+		return fresh
+	}
+	if v, ok := cc["max-stale"]; ok && !mustRevalidate(info) {
+		// Without an argument, max-stale accepts a response of any staleness.
+		maxStale, _ := parseSeconds(v)
+		if v == "" || age-lifetime <= maxStale {
+			return fresh
+		}
+	}
+	return stale
 }
 
+// Parses a Cache-Control header value into a map from lower case directive
+// names to their arguments, with any quotes removed. A directive without an
+// argument maps to the empty string.
+func parseCacheControl(s string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range splitList(s) {
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[0:i], strings.TrimSpace(part[i+1:])
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+		}
+		cc[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return cc
+}
+
+// Parses an HTTP-date in any of the three formats HTTP/1.1 allows.
+func parseHTTPDate(s string) (int64, bool) {
+	for _, layout := range []string{httpTimeFormat, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Seconds(), true
+		}
+	}
+	return 0, false
+}
+
+// Parses a delta-seconds value. Negative and malformed values give ok ==
+// false.
+func parseSeconds(s string) (n int64, ok bool) {
+	n, err := strconv.Atoi64(s)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+func infoTime(info map[string]string, key string) int64 {
+	t, _ := strconv.Atoi64(info[key])
+	return t
+}
+
+// The time the origin generated a stored response. Falls back to the time we
+// received it if the Date header is missing or malformed.
+func dateValue(info map[string]string) int64 {
+	if t, ok := parseHTTPDate(info["Date"]); ok {
+		return t
+	}
+	return infoTime(info, infoResponseTime)
+}
+
+// Returns how many seconds a stored response stays fresh after it was
+// generated, according to RFC 9111, section 4.2.1. Like cacheable, this
+// follows the rules for shared caches, so s-maxage wins over max-age.
+func freshnessLifetime(info map[string]string) int64 {
+	cc := parseCacheControl(info["Cache-Control"])
+	if v, ok := cc["s-maxage"]; ok {
+		n, _ := parseSeconds(v)
+		return n
+	}
+	if v, ok := cc["max-age"]; ok {
+		n, _ := parseSeconds(v)
+		return n
+	}
+
+	date := dateValue(info)
+	if v, ok := info["Expires"]; ok {
+		// An invalid Expires, such as "0", means already expired.
+		expires, ok := parseHTTPDate(v)
+		if !ok || expires < date {
+			return 0
+		}
+		return expires - date
+	}
+
+	// No explicit expiration time. Use the customary heuristic of 10% of
+	// the time since the response was last modified.
+	if lastModified, ok := parseHTTPDate(info["Last-Modified"]); ok && lastModified < date {
+		return (date - lastModified) / 10
+	}
+	return 0
+}
+
+// Returns the age in seconds of a stored response, according to RFC 9111,
+// section 4.2.3.
+func currentAge(info map[string]string) int64 {
+	requestTime := infoTime(info, infoRequestTime)
+	responseTime := infoTime(info, infoResponseTime)
+
+	apparentAge := responseTime - dateValue(info)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	ageValue, _ := parseSeconds(info["Age"])
+	correctedAge := ageValue + responseTime - requestTime
+	if correctedAge < apparentAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now() - responseTime
+}
+
+// Copies a response body into a store entry as it is read. The entry is
+// committed at EOF, and aborted on a read error or if it grows past max bytes
+// (if max > 0). Closing the body early reads the rest of it into the entry.
 type tee struct {
-	rc io.ReadCloser
-	buf *bytes.Buffer
-	isDone bool
-	onDone func(*tee)
+	rc  io.ReadCloser
+	w   StoreWriter // nil once committed or aborted
+	n   int64
+	max int64
 }
 
 func (t *tee) Read(buf []byte) (n int, err os.Error) {
 	n, err = t.rc.Read(buf)
-	t.buf.Write(buf[0:n])
-	if err == os.EOF && !t.isDone {
-		t.isDone = true
-		t.onDone(t)
+	if t.w != nil && n > 0 {
+		t.n += int64(n)
+		if t.max > 0 && t.n > t.max {
+			t.abort()
+		} else if _, werr := t.w.Write(buf[0:n]); werr != nil {
+			t.abort()
+		}
+	}
+	if t.w != nil && err != nil {
+		if err == os.EOF {
+			t.w.Commit()
+			t.w = nil
+		} else {
+			t.abort()
+		}
 	}
 	return
 }
 
+func (t *tee) abort() {
+	t.w.Abort()
+	t.w = nil
+}
+
 func (t *tee) Close() os.Error {
-	_, err := t.buf.ReadFrom(t.rc)
-	if err == nil && !t.isDone {
-		t.isDone = true
-		t.onDone(t)
+	buf := make([]byte, 32*1024)
+	for t.w != nil {
+		if _, err := t.Read(buf); err != nil {
+			break
+		}
+	}
+	if t.w != nil {
+		t.abort()
 	}
-
 	return t.rc.Close()
 }
-
@@ -0,0 +1,99 @@
+package httpc
+
+import (
+	"http"
+	"strconv"
+	"strings"
+)
+
+// The name a cache made by NewCache goes by in Cache-Status headers.
+const cacheStatusName = "httpc"
+
+// What a cache did with a response, as reported in its Cache-Status header
+// (RFC 9211). Every response that passes through a cache made by NewCache
+// gets one.
+type CacheStatus struct {
+	// The response was served from the store without contacting the
+	// origin.
+	Hit bool
+
+	// Why the request was forwarded to the next Sender, if it was:
+	// "uri-miss" if nothing was stored, "stale" to revalidate a stale
+	// entry, "request" if the request's directives didn't allow a stored
+	// response, or "method" if the request wasn't a GET.
+	Fwd string
+
+	// The status code of the forwarded response, if there was one.
+	FwdStatus int
+
+	// The response was stored, or will be once its body has been read.
+	Stored bool
+
+	// For hits, how many seconds the response has left before it goes
+	// stale. Negative if it is already stale.
+	TTL int64
+
+	// Anything else, such as "stale-if-error".
+	Detail string
+}
+
+// Formats s as a member of a Cache-Status header.
+func (s *CacheStatus) String() string {
+	x := cacheStatusName
+	if s.Hit {
+		x += "; hit; ttl=" + strconv.Itoa64(s.TTL)
+	}
+	if s.Fwd != "" {
+		x += "; fwd=" + s.Fwd
+	}
+	if s.FwdStatus != 0 {
+		x += "; fwd-status=" + strconv.Itoa(s.FwdStatus)
+	}
+	if s.Stored {
+		x += "; stored"
+	}
+	if s.Detail != "" {
+		x += "; detail=" + strconv.Quote(s.Detail)
+	}
+	return x
+}
+
+// Returns what the cache closest to us did with resp, according to its
+// Cache-Status header, or nil if resp didn't pass through a cache made by
+// NewCache. Entries added by other caches, such as a CDN's, are skipped.
+func GetCacheStatus(resp *http.Response) *CacheStatus {
+	members := splitList(resp.GetHeader("Cache-Status"))
+	for i := len(members) - 1; i >= 0; i-- {
+		params := splitQuoted(members[i], ';')
+		if len(params) == 0 || params[0] != cacheStatusName {
+			continue
+		}
+		s := new(CacheStatus)
+		for _, param := range params[1:] {
+			name, value := param, ""
+			if j := strings.Index(name, "="); j >= 0 {
+				name, value = name[0:j], name[j+1:]
+			}
+			switch name {
+			case "hit":
+				s.Hit = true
+			case "fwd":
+				s.Fwd = value
+			case "fwd-status":
+				s.FwdStatus, _ = strconv.Atoi(value)
+			case "stored":
+				s.Stored = true
+			case "ttl":
+				s.TTL, _ = strconv.Atoi64(value)
+			case "detail":
+				if d, err := strconv.Unquote(value); err == nil {
+					s.Detail = d
+				} else {
+					s.Detail = value
+				}
+			}
+		}
+		return s
+	}
+	return nil
+}
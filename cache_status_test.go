@@ -0,0 +1,63 @@
+package httpc
+
+import (
+	"http"
+	"testing"
+)
+
+func TestCacheStatusString(t *testing.T) {
+	s := &CacheStatus{Fwd: "stale", FwdStatus: 503, Detail: "stale-if-error"}
+	want := `httpc; fwd=stale; fwd-status=503; detail="stale-if-error"`
+	if got := s.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	s = &CacheStatus{Hit: true, TTL: -5}
+	if got := s.String(); got != "httpc; hit; ttl=-5" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestGetCacheStatus(t *testing.T) {
+	resp := &http.Response{Header: map[string]string{
+		"Cache-Status": `ExampleCDN; hit, httpc; fwd=uri-miss; fwd-status=200; stored; detail="a; b"`,
+	}}
+	s := GetCacheStatus(resp)
+	if s == nil {
+		t.Fatal("got nil status")
+	}
+	want := CacheStatus{Fwd: "uri-miss", FwdStatus: 200, Stored: true, Detail: "a; b"}
+	if s.String() != want.String() {
+		t.Errorf("got %#v, want %#v", *s, want)
+	}
+
+	resp.Header["Cache-Status"] = "ExampleCDN; hit"
+	if s := GetCacheStatus(resp); s != nil {
+		t.Errorf("want nil for another cache's status, got %#v", s)
+	}
+}
+
+func TestCacheStatusThroughCache(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/status"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Header["If-None-Match"] == "x" {
+			return testResponse(304, map[string]string{}, "")
+		}
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=10", "Etag": "x"}, "body")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+
+	want := []*CacheStatus{
+		&CacheStatus{Fwd: "uri-miss", FwdStatus: 200, Stored: true},
+		&CacheStatus{Hit: true, TTL: 6},
+		&CacheStatus{Fwd: "stale", FwdStatus: 304, Stored: true},
+	}
+	for i, age := range []int64{0, 4, 30} {
+		restore := setNow(testTime + age)
+		resp, _ := t.send(s, &http.Request{RawURL: url})
+		restore()
+		status := GetCacheStatus(resp)
+		t.need(status != nil, "Cache-Status on request %d", i)
+		t.assertEQ(status.String(), want[i].String(), "Cache-Status")
+	}
+}
@@ -2,8 +2,14 @@ package httpc
 
 import (
 	"http"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type T testing.T
@@ -11,14 +17,14 @@ type T testing.T
 func (t *T) want(b bool, format string, args ...interface{}) {
 	tt := (*testing.T)(t)
 	if !b {
-			tt.Errorf("want " + format, args)
+			tt.Errorf("want " + format, args...)
 	}
 }
 
 func (t *T) need(b bool, format string, args ...interface{}) {
 	tt := (*testing.T)(t)
 	if !b {
-			tt.Fatalf("need " + format, args)
+			tt.Fatalf("need " + format, args...)
 	}
 }
 
@@ -40,8 +46,8 @@ func TestUrlNorm(tt *testing.T) {
 	t.assertEQ("http://example.org/", normURL("http://EXAMple.org"), "")
 	t.assertEQ("http://example.org/?=b", normURL("http://EXAMple.org?=b"), "")
 	t.assertEQ("http://example.org/mypath?a=b", normURL("http://EXAMple.org/mypath?a=b"), "")
-	t.assertEQ("http://localhost:80/", normURL("http://localhost:80"), "")
-	t.assertEQ("http://localhost:80/", normURL("HTTP://LOCALHOST:80"), "")
+	t.assertEQ("http://localhost/", normURL("http://localhost:80"), "")
+	t.assertEQ("http://localhost/", normURL("HTTP://LOCALHOST:80"), "")
 	t.assertEQ("/", normURL("/"), "")
 	t.assertEQ(normURL("http://www"), normURL("http://WWW"), "")
 }
@@ -51,7 +57,8 @@ var testEtags = make(map[string]*http.Response)
 var dummyResponses = map[string]*http.Response {
 	"http://localhost/304/test_etag.txt": &http.Response{
 		Header: map[string]string{
-			"ETag": "abc",
+			"Etag":          "abc",
+			"Cache-Control": "max-age=3600",
 		},
 		Body: &stringReadCloser{[]byte("dummy contents"), 0},
 	},
@@ -59,7 +66,7 @@ var dummyResponses = map[string]*http.Response {
 
 func init() {
 	for _, r := range dummyResponses {
-		if etag, ok := r.Header["ETag"]; ok {
+		if etag, ok := r.Header["Etag"]; ok {
 			testEtags[etag] = r
 		}
 	}
@@ -100,14 +107,887 @@ func TestGetOnlyIfCachedCacheHit(tt *testing.T) {
 	if resp == nil {
 		tt.Fatal("got nil resp")
 	}
-	t.assertEQ(resp.GetHeader("Via"), "", "Via")
+	t.assertEQ(resp.GetHeader("Cache-Status"), "httpc; fwd=uri-miss; fwd-status=200; stored", "Cache-Status")
 	resp.Body.Close()
 	resp, err = s.Send(&http.Request{RawURL:url, Header:map[string]string{"Cache-Control":"Only-If-Cached"}})
 	t.noErr(err)
 	if resp == nil {
 		tt.Fatal("got nil resp")
 	}
-	t.assertEQ(resp.GetHeader("Via"), "1.1 internal (httpc.go)", "Via")
+	status := GetCacheStatus(resp)
+	t.need(status != nil, "Cache-Status")
+	t.assertEQ(status.Hit, true, "hit")
 	t.assertEQ(resp.StatusCode, 200, "status")
 }
 
+// Answers each request with a fresh response from f, and counts them.
+type funcSender struct {
+	n int
+	f func(req *http.Request) *http.Response
+}
+
+// A nil response from f is sent as an error, as if the origin were down.
+func (s *funcSender) Send(req *http.Request) (*http.Response, os.Error) {
+	s.n++
+	if req.Header == nil {
+		req.Header = map[string]string{}
+	}
+	resp := s.f(req)
+	if resp == nil {
+		return nil, os.NewError("origin down")
+	}
+	return resp, nil
+}
+
+func testResponse(code int, header map[string]string, body string) *http.Response {
+	return &http.Response{
+		Status:     strconv.Itoa(code),
+		StatusCode: code,
+		Header:     header,
+		Body:       &stringReadCloser{[]byte(body), 0},
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp.Body.Close()
+	return string(b)
+}
+
+// Makes the cache clock read t until the returned func is called.
+func setNow(t int64) (restore func()) {
+	saved := now
+	now = func() int64 { return t }
+	return func() { now = saved }
+}
+
+const (
+	testTime = 1287000000 // Wed, 13 Oct 2010 20:00:00 GMT
+	testDate = "Wed, 13 Oct 2010 20:00:00 GMT"
+)
+
+// Sends req with s, and returns the response and its body.
+func (t *T) send(s Sender, req *http.Request) (*http.Response, string) {
+	resp, err := s.Send(req)
+	t.noErr(err)
+	return resp, readBody((*testing.T)(t), resp)
+}
+
+// Has s fetch url, as if at time when, so that it stores the response.
+func (t *T) prime(s Sender, url string, when int64) {
+	defer setNow(when)()
+	t.send(s, &http.Request{RawURL: url})
+}
+
+func TestParseHTTPDate(t *testing.T) {
+	for _, s := range []string{testDate, "Wednesday, 13-Oct-10 20:00:00 GMT", "Wed Oct 13 20:00:00 2010"} {
+		got, ok := parseHTTPDate(s)
+		if !ok || got != testTime {
+			t.Errorf("parseHTTPDate(%q) = %d, %v, want %d", s, got, ok, testTime)
+		}
+	}
+	if _, ok := parseHTTPDate("0"); ok {
+		t.Error("want bad date for \"0\"")
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(`Max-Age=60, no-cache="Set-Cookie, X-Foo", public`)
+	if v, ok := cc["max-age"]; !ok || v != "60" {
+		t.Errorf("max-age = %q, %v", v, ok)
+	}
+	if v, ok := cc["no-cache"]; !ok || v != "Set-Cookie, X-Foo" {
+		t.Errorf("no-cache = %q, %v", v, ok)
+	}
+	if v, ok := cc["public"]; !ok || v != "" {
+		t.Errorf("public = %q, %v", v, ok)
+	}
+}
+
+var freshnessTests = []struct {
+	header   map[string]string
+	lifetime int64
+}{
+	{map[string]string{}, 0},
+	{map[string]string{"Cache-Control": "max-age=300"}, 300},
+	{map[string]string{"Cache-Control": "max-age=300", "Expires": "Wed, 13 Oct 2010 21:00:00 GMT"}, 300},
+	{map[string]string{"Cache-Control": "max-age=300, s-maxage=30"}, 30},
+	{map[string]string{"Date": testDate, "Expires": "Wed, 13 Oct 2010 21:00:00 GMT"}, 3600},
+	{map[string]string{"Date": testDate, "Expires": "0"}, 0},
+	{map[string]string{"Date": testDate, "Last-Modified": "Wed, 13 Oct 2010 10:00:00 GMT"}, 3600},
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	for i, ft := range freshnessTests {
+		info := map[string]string{infoResponseTime: strconv.Itoa64(testTime)}
+		for k, v := range ft.header {
+			info[k] = v
+		}
+		if got := freshnessLifetime(info); got != ft.lifetime {
+			t.Errorf("test %d: lifetime %d, want %d", i, got, ft.lifetime)
+		}
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	defer setNow(testTime + 100)()
+	info := map[string]string{
+		"Date":           "Wed, 13 Oct 2010 19:59:50 GMT",
+		"Age":            "5",
+		infoRequestTime:  strconv.Itoa64(testTime - 2),
+		infoResponseTime: strconv.Itoa64(testTime),
+	}
+	// The apparent age (10s) beats the corrected Age value (5s + 2s delay).
+	if age := currentAge(info); age != 110 {
+		t.Errorf("age %d, want 110", age)
+	}
+	info["Age"] = "30"
+	if age := currentAge(info); age != 132 {
+		t.Errorf("age %d, want 132", age)
+	}
+}
+
+func TestState(t *testing.T) {
+	info := map[string]string{
+		"Date":           testDate,
+		"Cache-Control":  "max-age=60",
+		infoRequestTime:  strconv.Itoa64(testTime),
+		infoResponseTime: strconv.Itoa64(testTime),
+	}
+	restore := setNow(testTime + 59)
+	if state(info, nil) != fresh {
+		t.Error("want fresh before max-age")
+	}
+	restore()
+	defer setNow(testTime + 60)()
+	if state(info, nil) != stale {
+		t.Error("want stale at max-age")
+	}
+}
+
+func TestRevalidateNotModified(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/etag"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Header["If-None-Match"] == `"v1"` {
+			return testResponse(304, map[string]string{
+				"Cache-Control": "max-age=100",
+				"X-New":         "yes",
+			}, "")
+		}
+		return testResponse(200, map[string]string{
+			"Etag":          `"v1"`,
+			"Cache-Control": "max-age=10",
+		}, "v1 body")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	defer setNow(testTime + 20)()
+	for i := 0; i < 2; i++ {
+		resp, body := t.send(s, &http.Request{RawURL: url})
+		t.assertEQ(body, "v1 body", "body")
+		t.assertEQ(resp.StatusCode, 200, "status")
+		t.want(resp.GetHeader("X-New") == "yes", "headers from 304 merged into the stored entry")
+	}
+	t.assertEQ(origin.n, 2, "origin requests")
+}
+
+func TestRevalidateModified(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/last-modified"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Header["If-Modified-Since"] != testDate {
+			return testResponse(200, map[string]string{
+				"Last-Modified": testDate,
+				"Cache-Control": "max-age=10",
+			}, "old")
+		}
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=10"}, "new")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	defer setNow(testTime + 20)()
+	for i := 0; i < 2; i++ {
+		_, body := t.send(s, &http.Request{RawURL: url})
+		t.assertEQ(body, "new", "body")
+	}
+	t.assertEQ(origin.n, 2, "origin requests")
+}
+
+func TestVary(t *testing.T) {
+	url := "http://localhost/vary"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{
+			"Cache-Control": "max-age=100",
+			"Vary":          "accept-language",
+		}, req.Header["Accept-Language"])
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+
+	for _, lang := range []string{"en", "fr", "en", "fr"} {
+		req := &http.Request{RawURL: url, Header: map[string]string{"Accept-Language": lang}}
+		resp, err := s.Send(req)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if body := readBody(t, resp); body != lang {
+			t.Errorf("body %q, want %q", body, lang)
+		}
+	}
+	if origin.n != 2 {
+		t.Errorf("origin saw %d requests, want 2", origin.n)
+	}
+}
+
+func TestVaryStar(t *testing.T) {
+	url := "http://localhost/vary-star"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{
+			"Cache-Control": "max-age=100",
+			"Vary":          "*",
+		}, "x")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+
+	for i := 0; i < 2; i++ {
+		resp, err := s.Send(&http.Request{RawURL: url})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+	if origin.n != 2 {
+		t.Errorf("origin saw %d requests, want 2", origin.n)
+	}
+}
+
+// A variant the marker doesn't list, such as one whose marker update was
+// lost, is not served.
+func TestVaryUnlisted(t *testing.T) {
+	url := "http://localhost/vary-unlisted"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{
+			"Cache-Control": "max-age=100",
+			"Vary":          "Accept-Language",
+		}, req.Header["Accept-Language"])
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCache(store, origin)
+	defer setNow(testTime)()
+
+	resp, err := s.Send(&http.Request{RawURL: url, Header: map[string]string{"Accept-Language": "en"}})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	readBody(t, resp)
+	info, _ := store.Get(variantKey(normURL(url), []string{"Accept-Language"}, map[string]string{"Accept-Language": "en"}))
+	if info == nil {
+		t.Fatal("want variant en stored")
+	}
+	stray := map[string]string{}
+	for k, v := range info {
+		stray[k] = v
+	}
+	stray[infoVaryPrefix+"Accept-Language"] = "fr"
+	fr := map[string]string{"Accept-Language": "fr"}
+	store.Set(variantKey(normURL(url), []string{"Accept-Language"}, fr), stray, []byte("en"))
+
+	resp, err = s.Send(&http.Request{RawURL: url, Header: fr})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "fr" {
+		t.Errorf("body %q, want fr", body)
+	}
+	if origin.n != 2 {
+		t.Errorf("origin saw %d requests, want 2", origin.n)
+	}
+}
+
+var requestDirectiveTests = []struct {
+	cacheControl string
+	age          int64
+	state        int
+}{
+	{"", 50, fresh},
+	{"", 60, stale},
+	{"no-cache", 0, stale},
+	{"max-age=20", 30, stale},
+	{"max-age=20", 10, fresh},
+	{"min-fresh=15", 50, stale},
+	{"min-fresh=5", 50, fresh},
+	{"max-stale", 1000, fresh},
+	{"max-stale=10", 70, fresh},
+	{"max-stale=10", 71, stale},
+}
+
+func TestRequestDirectives(t *testing.T) {
+	info := map[string]string{
+		"Date":           testDate,
+		"Cache-Control":  "max-age=60",
+		infoRequestTime:  strconv.Itoa64(testTime),
+		infoResponseTime: strconv.Itoa64(testTime),
+	}
+	for i, rt := range requestDirectiveTests {
+		restore := setNow(testTime + rt.age)
+		header := map[string]string{"Cache-Control": rt.cacheControl}
+		if got := state(info, header); got != rt.state {
+			t.Errorf("test %d: %q at age %d: state %d, want %d", i, rt.cacheControl, rt.age, got, rt.state)
+		}
+		restore()
+	}
+	if state(info, map[string]string{"Pragma": "no-cache"}) != stale {
+		t.Error("want Pragma: no-cache to force revalidation")
+	}
+}
+
+func TestOnlyIfCachedMiss(t *testing.T) {
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{}, "x")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	req := &http.Request{RawURL: "http://localhost/miss", Header: map[string]string{"Cache-Control": "only-if-cached"}}
+	resp, err := s.Send(req)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if resp.StatusCode != 504 {
+		t.Errorf("status %d, want 504", resp.StatusCode)
+	}
+	if origin.n != 0 {
+		t.Errorf("origin saw %d requests, want 0", origin.n)
+	}
+}
+
+func TestRequestNoCacheAndNoStore(t *testing.T) {
+	url := "http://localhost/no-cache"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, "x")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+
+	for _, cc := range []string{"", "no-cache", "no-store", ""} {
+		resp, err := s.Send(&http.Request{RawURL: url, Header: map[string]string{"Cache-Control": cc}})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+	if origin.n != 3 {
+		t.Errorf("origin saw %d requests, want 3", origin.n)
+	}
+}
+
+var cacheableTests = []struct {
+	method string
+	header map[string]string // request
+	code   int
+	cc     string // response Cache-Control
+	want   bool
+}{
+	{"GET", nil, 200, "", true},
+	{"", nil, 404, "", true},
+	{"POST", nil, 200, "max-age=60", false},
+	{"HEAD", nil, 200, "max-age=60", false},
+	{"GET", nil, 500, "", false},
+	{"GET", nil, 500, "max-age=60", true},
+	{"GET", nil, 302, "", false},
+	{"GET", nil, 302, "public", true},
+	{"GET", nil, 206, "max-age=60", false},
+	{"GET", nil, 200, "no-store", false},
+	{"GET", nil, 200, "private, max-age=60", false},
+	{"GET", nil, 200, "no-cache", true},
+	{"GET", map[string]string{"Cache-Control": "no-store"}, 200, "", false},
+	{"GET", map[string]string{"Authorization": "Basic eDp5"}, 200, "max-age=60", false},
+	{"GET", map[string]string{"Authorization": "Basic eDp5"}, 200, "public", true},
+	{"GET", map[string]string{"Authorization": "Basic eDp5"}, 200, "must-revalidate", true},
+}
+
+func TestCacheable(t *testing.T) {
+	for i, ct := range cacheableTests {
+		req := &http.Request{Method: ct.method, Header: ct.header}
+		if req.Header == nil {
+			req.Header = map[string]string{}
+		}
+		resp := testResponse(ct.code, map[string]string{"Cache-Control": ct.cc}, "")
+		if got := cacheable(req, resp); got != ct.want {
+			t.Errorf("test %d: cacheable %v, want %v", i, got, ct.want)
+		}
+	}
+}
+
+func TestNotStored(tt *testing.T) {
+	t := (*T)(tt)
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{"Cache-Control": "no-store"}, "secret")
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCache(store, origin)
+	url := "http://localhost/no-store"
+	t.prime(s, url, testTime)
+	info, _ := store.Get(normURL(url))
+	t.want(info == nil, "no-store response left out of the store, got %#v", info)
+}
+
+func TestMustRevalidate(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/must-revalidate"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=10, must-revalidate"}, "x")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	defer setNow(testTime + 20)()
+	resp, _ := t.send(s, &http.Request{RawURL: url, Header: map[string]string{"Cache-Control": "only-if-cached"}})
+	t.assertEQ(resp.StatusCode, 504, "only-if-cached status")
+	t.send(s, &http.Request{RawURL: url, Header: map[string]string{"Cache-Control": "max-stale"}})
+	t.assertEQ(origin.n, 2, "origin requests")
+}
+
+func TestInvalidate(t *testing.T) {
+	url := "http://localhost/doc"
+	version := "v1"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		switch req.Method {
+		case "PUT":
+			version = "v2"
+			return testResponse(204, map[string]string{"Content-Location": "/other"}, "")
+		case "DELETE":
+			return testResponse(500, map[string]string{}, "")
+		}
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, version)
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCache(store, origin)
+	defer setNow(testTime)()
+
+	get := func(url string) string {
+		resp, err := s.Send(&http.Request{RawURL: url})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		return readBody(t, resp)
+	}
+	send := func(method string) {
+		resp, err := s.Send(&http.Request{Method: method, RawURL: url, Header: map[string]string{}})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+
+	get(url)
+	get("http://localhost/other")
+	send("DELETE") // fails, so nothing is invalidated
+	if body := get(url); body != "v1" {
+		t.Errorf("body %q, want v1", body)
+	}
+	send("PUT")
+	if body := get(url); body != "v2" {
+		t.Errorf("body %q, want v2", body)
+	}
+	if info, _ := store.Get(normURL("http://localhost/other")); info != nil {
+		t.Error("want Content-Location invalidated")
+	}
+}
+
+// Signals on done when closed.
+type notifyingBody struct {
+	io.ReadCloser
+	done chan bool
+}
+
+func (b notifyingBody) Close() os.Error {
+	err := b.ReadCloser.Close()
+	select {
+	case b.done <- true:
+	default:
+	}
+	return err
+}
+
+func TestStaleWhileRevalidate(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/swr"
+	version := "v1"
+	refreshed := make(chan bool, 1)
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		resp := testResponse(200, map[string]string{
+			"Cache-Control": "max-age=10, stale-while-revalidate=60",
+		}, version)
+		if version == "v2" {
+			// The refresh closes the body once it has stored it.
+			resp.Body = notifyingBody{resp.Body, refreshed}
+		}
+		return resp
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	defer setNow(testTime + 20)()
+	version = "v2"
+	_, body := t.send(s, &http.Request{RawURL: url})
+	t.assertEQ(body, "v1", "stale body")
+
+	select {
+	case <-refreshed:
+	case <-time.After(5e9):
+		t.need(false, "background refresh")
+	}
+	t.assertEQ(origin.n, 2, "origin requests")
+	_, body = t.send(s, &http.Request{RawURL: url})
+	t.assertEQ(body, "v2", "refreshed body")
+}
+
+var staleIfErrorTests = []struct {
+	cacheControl string // response
+	opts         CacheOptions
+	age          int64
+	originErr    bool // or else a 503
+	served       bool
+}{
+	{"max-age=10", CacheOptions{}, 20, true, false},
+	{"max-age=10, stale-if-error=60", CacheOptions{}, 20, true, true},
+	{"max-age=10, stale-if-error=60", CacheOptions{}, 20, false, true},
+	{"max-age=10, stale-if-error=60", CacheOptions{}, 80, true, false},
+	{"max-age=10", CacheOptions{StaleIfError: 60}, 20, false, true},
+	{"max-age=10, stale-if-error=0", CacheOptions{StaleIfError: 60}, 20, true, false},
+	{"max-age=10, must-revalidate", CacheOptions{StaleIfError: 60}, 20, true, false},
+}
+
+func TestStaleIfError(tt *testing.T) {
+	t := (*T)(tt)
+	for i, st := range staleIfErrorTests {
+		url := "http://localhost/stale-if-error"
+		up := true
+		originErr := st.originErr
+		cacheControl := st.cacheControl
+		origin := &funcSender{f: func(req *http.Request) *http.Response {
+			if up {
+				return testResponse(200, map[string]string{"Cache-Control": cacheControl}, "stale")
+			}
+			if originErr {
+				return nil
+			}
+			return testResponse(503, map[string]string{}, "")
+		}}
+		s := NewCacheWithOptions(NewMemoryStore(1000), origin, st.opts)
+		t.prime(s, url, testTime)
+
+		up = false
+		restore := setNow(testTime + st.age)
+		resp, err := s.Send(&http.Request{RawURL: url})
+		restore()
+		served := err == nil && resp.StatusCode == 200
+		t.want(served == st.served, "test %d: served stale %v", i, st.served)
+		if served {
+			warning := resp.GetHeader("Warning")
+			t.want(warning == `110 - "Response is Stale", 111 - "Revalidation Failed"`, "test %d: Warnings, got %q", i, warning)
+		}
+	}
+}
+
+func TestCachedStatusLine(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/gone"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		resp := testResponse(404, map[string]string{
+			"Cache-Control":  "max-age=100",
+			"Content-Length": "4",
+			"Age":            "3",
+		}, "gone")
+		resp.Status = "404 Not Found"
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.0", 1, 0
+		return resp
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	defer setNow(testTime + 7)()
+	req := &http.Request{RawURL: url}
+	resp, _ := t.send(s, req)
+	t.need(origin.n == 1, "a cache hit, origin saw %d requests", origin.n)
+	t.assertEQ(resp.StatusCode, 404, "status code")
+	t.assertEQ(resp.Status, "404 Not Found", "status")
+	t.assertEQ(resp.Proto, "HTTP/1.0", "proto")
+	t.assertEQ(resp.ProtoMajor, 1, "proto major")
+	t.assertEQ(resp.ProtoMinor, 0, "proto minor")
+	t.assertEQ(resp.ContentLength, int64(4), "content length")
+	t.assertEQ(resp.GetHeader("Age"), "10", "Age")
+	t.want(resp.Request == req, "the request set on the response")
+	for k := range resp.Header {
+		t.want(!strings.HasPrefix(k, infoPrefix), "no cache bookkeeping in the header, got %q", k)
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	url := "http://localhost/collapse"
+	var mu sync.Mutex
+	n := 0
+	release := make(chan bool)
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		<-release
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, "shared")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+
+	const callers = 20
+	bodies := make(chan string)
+	for i := 0; i < callers; i++ {
+		go func() {
+			resp, err := s.Send(&http.Request{RawURL: url})
+			if err != nil {
+				bodies <- err.String()
+				return
+			}
+			bodies <- readBody(t, resp)
+		}()
+	}
+	// Give everyone a chance to join the first fetch.
+	time.Sleep(50e6)
+	close(release)
+	for i := 0; i < callers; i++ {
+		if body := <-bodies; body != "shared" {
+			t.Errorf("body %q, want shared", body)
+		}
+	}
+	if n != 1 {
+		t.Errorf("origin saw %d requests, want 1", n)
+	}
+}
+
+// A request that gives up waiting on a leader that never reads its body takes
+// the fetch over, so that the stuck one doesn't hold up the key for good.
+func TestCollapseTakeOver(t *testing.T) {
+	url := "http://localhost/leaked"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, "x")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+	defer func(wait int64) { maxCollapseWait = wait }(maxCollapseWait)
+	maxCollapseWait = 10e6
+
+	// The first response's body is never read.
+	if _, err := s.Send(&http.Request{RawURL: url}); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	resp, err := s.Send(&http.Request{RawURL: url})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	readBody(t, resp)
+	if origin.n != 2 {
+		t.Errorf("origin saw %d requests, want 2", origin.n)
+	}
+	if n := len(s.(cache).flights.m); n != 0 {
+		t.Errorf("%d flights left in progress, want 0", n)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, "x")
+	}}
+	// Ignore everything after "utm_" tracking parameters begin.
+	key := func(req *http.Request) string {
+		url := req.RawURL
+		if i := strings.Index(url, "utm_"); i >= 0 {
+			url = strings.TrimRight(url[0:i], "?&")
+		}
+		return NormalizeURL(url, true)
+	}
+	s := NewCacheWithOptions(NewMemoryStore(1000), origin, CacheOptions{Key: key})
+	defer setNow(testTime)()
+
+	for _, url := range []string{
+		"http://localhost/key?b=2&a=1",
+		"http://LOCALHOST:80/key?a=1&b=2&utm_source=mail",
+		"http://localhost/./key?a=1&b=2#top",
+	} {
+		resp, err := s.Send(&http.Request{RawURL: url})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+	if origin.n != 1 {
+		t.Errorf("origin saw %d requests, want 1", origin.n)
+	}
+}
+
+func TestMaxObjectSize(t *testing.T) {
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		resp := testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, req.RawURL[len("http://localhost/"):])
+		resp.ContentLength = -1
+		return resp
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCacheWithOptions(store, origin, CacheOptions{MaxObjectSize: 5})
+	defer setNow(testTime)()
+
+	for _, url := range []string{"http://localhost/small", "http://localhost/too-big"} {
+		resp, err := s.Send(&http.Request{RawURL: url})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if body := readBody(t, resp); body != url[len("http://localhost/"):] {
+			t.Errorf("body %q", body)
+		}
+	}
+	if info, _ := store.Get(normURL("http://localhost/small")); info == nil {
+		t.Error("want small response stored")
+	}
+	if info, _ := store.Get(normURL("http://localhost/too-big")); info != nil {
+		t.Error("want big response left out")
+	}
+}
+
+// An encoded response is stored as it is, Content-Encoding and all, and a 304
+// can't change the coding of what's stored.
+func TestContentEncodingStored(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/gzip"
+	content := encode("gzip", "body")
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Header["If-None-Match"] == `"x"` {
+			return testResponse(304, map[string]string{
+				"Etag":             `"x"`,
+				"Cache-Control":    "max-age=100",
+				"Content-Encoding": "identity",
+			}, "")
+		}
+		return testResponse(200, map[string]string{
+			"Etag":             `"x"`,
+			"Cache-Control":    "max-age=100",
+			"Content-Encoding": "gzip",
+		}, content)
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	t.prime(s, url, testTime)
+
+	for _, when := range []int64{testTime + 10, testTime + 200} {
+		restore := setNow(when)
+		resp, body := t.send(s, &http.Request{RawURL: url})
+		restore()
+		t.want(body == content, "at %d: the gzip content, got %q", when, body)
+		t.assertEQ(resp.Header["Content-Encoding"], "gzip", "Content-Encoding")
+	}
+}
+
+// A response encoded for a request that asked for the coding isn't served to
+// requests that didn't, even if the origin leaves out Vary.
+func TestContentEncodingNegotiated(tt *testing.T) {
+	t := (*T)(tt)
+	url := "http://localhost/negotiated"
+	content := encode("gzip", "body")
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Header["Accept-Encoding"] == "gzip" {
+			return testResponse(200, map[string]string{
+				"Cache-Control":    "max-age=100",
+				"Content-Encoding": "gzip",
+			}, content)
+		}
+		return testResponse(200, map[string]string{"Cache-Control": "max-age=100"}, "body")
+	}}
+	s := NewCache(NewMemoryStore(1000), origin)
+	defer setNow(testTime)()
+
+	_, body := t.send(s, &http.Request{RawURL: url, Header: map[string]string{"Accept-Encoding": "gzip"}})
+	t.want(body == content, "the gzip content, got %q", body)
+	resp, body := t.send(s, &http.Request{RawURL: url})
+	t.assertEQ(body, "body", "body")
+	t.assertEQ(resp.Header["Content-Encoding"], "", "Content-Encoding")
+	t.assertEQ(origin.n, 2, "origin requests")
+	// The plain one will do for anyone.
+	_, body = t.send(s, &http.Request{RawURL: url, Header: map[string]string{"Accept-Encoding": "gzip"}})
+	t.assertEQ(body, "body", "body")
+	t.assertEQ(origin.n, 2, "origin requests")
+}
+
+// A response that varies on everything replaces what was stored before.
+func TestVaryStarDeletes(t *testing.T) {
+	url := "http://localhost/vary-star-later"
+	vary := ""
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		header := map[string]string{"Cache-Control": "max-age=100, stale-if-error=1000"}
+		if vary != "" {
+			header["Vary"] = vary
+		}
+		return testResponse(200, header, "x")
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCache(store, origin)
+	defer setNow(testTime)()
+
+	for _, v := range []string{"", "*"} {
+		vary = v
+		resp, err := s.Send(&http.Request{RawURL: url, Header: map[string]string{"Cache-Control": "no-cache"}})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+	if info, _ := store.Get(normURL(url)); info != nil {
+		t.Errorf("want the earlier response deleted, got %#v", info)
+	}
+}
+
+// Invalidation deletes every stored variant, not just the marker.
+func TestInvalidateVariants(t *testing.T) {
+	url := "http://localhost/vary-doc"
+	origin := &funcSender{f: func(req *http.Request) *http.Response {
+		if req.Method == "PUT" {
+			return testResponse(204, map[string]string{}, "")
+		}
+		return testResponse(200, map[string]string{
+			"Cache-Control": "max-age=100",
+			"Vary":          "Accept-Language",
+		}, req.Header["Accept-Language"])
+	}}
+	store := NewMemoryStore(1000)
+	s := NewCache(store, origin)
+	defer setNow(testTime)()
+
+	langs := []string{"en", "fr"}
+	for _, lang := range langs {
+		resp, err := s.Send(&http.Request{RawURL: url, Header: map[string]string{"Accept-Language": lang}})
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		readBody(t, resp)
+	}
+	names := []string{"Accept-Language"}
+	for _, lang := range langs {
+		if info, _ := store.Get(variantKey(normURL(url), names, map[string]string{"Accept-Language": lang})); info == nil {
+			t.Fatalf("want variant %s stored", lang)
+		}
+	}
+
+	resp, err := s.Send(&http.Request{Method: "PUT", RawURL: url, Header: map[string]string{}})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	readBody(t, resp)
+	for _, lang := range langs {
+		if info, _ := store.Get(variantKey(normURL(url), names, map[string]string{"Accept-Language": lang})); info != nil {
+			t.Errorf("want variant %s deleted", lang)
+		}
+	}
+	if info, _ := store.Get(normURL(url)); info != nil {
+		t.Error("want marker deleted")
+	}
+}
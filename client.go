@@ -1,20 +1,44 @@
 package httpc
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"container/heap"
+	"crypto/tls"
 	"fmt"
 	"http"
+	"io"
 	"os"
+	"strings"
 )
 
 // Manages connection pools for all domains.
 type client struct {
 	limitGlobal    int
 	limitPerDomain int
+	opts           ClientOptions
 	reqs           chan *clientRequest
 	poolGetter     chan poolPromise
 }
 
+// Optional settings for NewClientWithOptions. The zero value gives the
+// defaults.
+type ClientOptions struct {
+	// The TLS settings for https, such as the root certificates to trust.
+	// The server name is filled in for each connection. If nil, the
+	// defaults of package tls are used.
+	TLSConfig *tls.Config
+
+	// Returns the proxy to use for requests to the scheme and host of u,
+	// or nil to connect directly. The proxy's scheme is http, or socks5
+	// or socks5h for a SOCKS5 proxy; either way, unlike in some other
+	// programs, the proxy is left to look up host names. It is
+	// called for each new connection; the limit per domain applies to
+	// each scheme and host, even when all go through one proxy. If nil,
+	// ProxyFromEnvironment is used; ProxyURL(nil) connects directly.
+	Proxy func(u *http.URL) (*http.URL, os.Error)
+}
+
 type clientRequest struct {
 	r *http.Request
 	success chan *http.Response
@@ -26,8 +50,9 @@ type poolPromise struct {
 	promise chan *pool
 }
 
-func (c *client) getPool(domain string) *pool {
-	pp := poolPromise{domain, make(chan *pool)}
+// Returns the pool for addr, a scheme, host and port; see poolKey.
+func (c *client) getPool(addr string) *pool {
+	pp := poolPromise{addr, make(chan *pool)}
 	c.poolGetter <- pp
 	return <-pp.promise
 }
@@ -45,11 +70,17 @@ func (c *client) managePools(poolMaker func(string) *pool) {
 	}
 }
 
+// Returns the name of the pool for requests to u: its scheme, host and port,
+// such as "https://example.org:443", so that leaving out the default port
+// doesn't make for a pool of its own.
+func poolKey(u *http.URL) string {
+	return u.Scheme + "://" + withPort(u.Scheme, u.Host)
+}
+
 func (c *client) accept() {
 	for {
 		r := <-c.reqs
-		d := r.r.URL.Host
-		p := c.getPool(d)
+		p := c.getPool(poolKey(r.r.URL))
 		p.reqs <- r
 	}
 }
@@ -102,11 +133,41 @@ func (c *client) drive(incReq, decReq chan *pool) {
 //   X-Pri: 2000
 // sets the priority of the request to 2000. X-Pri will never be sent over the
 // wire. It is used by the client only internally.
+//
+// Requests go through the proxy that ProxyFromEnvironment gives, if any.
 func NewClient(limitGlobal, limitPerDomain int) Sender {
-	c := &client{limitGlobal, limitPerDomain, make(chan *clientRequest), make(chan poolPromise)}
+	return NewClientWithOptions(limitGlobal, limitPerDomain, ClientOptions{})
+}
+
+// Like NewClient, with the settings in opts.
+func NewClientWithOptions(limitGlobal, limitPerDomain int, opts ClientOptions) Sender {
+	c := &client{limitGlobal, limitPerDomain, opts, make(chan *clientRequest), make(chan poolPromise)}
+	getProxy := opts.Proxy
+	if getProxy == nil {
+		getProxy = ProxyFromEnvironment
+	}
 	incReq := make(chan *pool)
 	decReq := make(chan *pool)
-	go c.managePools(func(addr string) *pool { return newPool(addr, c.limitPerDomain, incReq, decReq) })
+	go c.managePools(func(addr string) *pool {
+		i := strings.Index(addr, "://")
+		scheme, host := addr[0:i], addr[i+3:]
+		dialer := func() (*poolConn, os.Error) {
+			proxy, err := getProxy(&http.URL{Scheme: scheme, Host: host})
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dial(scheme, host, proxy, c.opts.TLSConfig)
+			if err != nil {
+				return nil, err
+			}
+			pc := &poolConn{ClientConn: conn}
+			if proxy != nil && proxy.Scheme == "http" && scheme == "http" {
+				pc.prepare = func(r *http.Request) *http.Request { return proxyRequest(r, proxy) }
+			}
+			return pc, nil
+		}
+		return newPool(addr, c.limitPerDomain, dialer, incReq, decReq)
+	})
 	go c.accept()
 	go c.drive(incReq, decReq)
 	return c
@@ -116,16 +177,81 @@ func (c *client) Send(req *http.Request) (resp *http.Response, err os.Error) {
 	if req.URL, err = http.ParseURL(req.RawURL); err != nil {
 		return
 	}
-	if req.URL.Scheme != "http" {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
 		return nil, os.ErrorString(fmt.Sprintf("bad scheme %s", req.URL.Scheme))
 	}
+
+	// Unless the caller asked for particular encodings, and so wants them
+	// as they come, ask for compressed content and decode it here.
+	decode := false
+	if _, ok := req.Header["Accept-Encoding"]; !ok {
+		req = withAcceptEncoding(req)
+		decode = true
+	}
+
 	cr := &clientRequest{req, make(chan *http.Response), make(chan os.Error)}
 	c.reqs <- cr
 	select {
 	case resp = <-cr.success:
 	case err = <-cr.failure:
 	}
+	if err == nil && decode {
+		if err = decodeResponse(req, resp); err != nil {
+			// The body is closed; nobody can use resp.
+			return nil, err
+		}
+	}
 	return
 }
 
-func shouldRedirect(status int) bool { return false }
+// The content codings the client can decode, as an Accept-Encoding header.
+const acceptEncoding = "gzip, deflate"
+
+// Returns a copy of req that asks for acceptEncoding.
+func withAcceptEncoding(req *http.Request) *http.Request {
+	x := new(http.Request)
+	*x = *req
+	x.Header = map[string]string{"Accept-Encoding": acceptEncoding}
+	for k, v := range req.Header {
+		x.Header[k] = v
+	}
+	return x
+}
+
+// Replaces a gzip or deflate coded body of resp by its decoding, and fixes
+// the header to match. Other codings are left alone. If the body can't be
+// decoded, it is closed, and an error returned.
+func decodeResponse(req *http.Request, resp *http.Response) os.Error {
+	coding := resp.Header["Content-Encoding"]
+	if coding != "gzip" && coding != "deflate" {
+		return nil
+	}
+	if req.Method == "HEAD" || resp.StatusCode == 204 || resp.StatusCode == 304 || resp.Body == nil {
+		return nil
+	}
+	var r io.ReadCloser
+	var err os.Error
+	if coding == "gzip" {
+		r, err = gzip.NewReader(resp.Body)
+	} else {
+		// HTTP's deflate is the zlib format (RFC 9110, section 8.4.1.2).
+		r, err = zlib.NewReader(resp.Body)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	resp.Body = &decompressor{r, resp.Body}
+	resp.Header["Content-Encoding"] = "", false
+	resp.Header["Content-Length"] = "", false
+	resp.ContentLength = -1
+	return nil
+}
+
+func shouldRedirect(status int) bool {
+	switch status {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
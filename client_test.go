@@ -0,0 +1,167 @@
+package httpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"http"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encode(coding, s string) string {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if coding == "gzip" {
+		w, _ = gzip.NewWriter(&buf)
+	} else {
+		w, _ = zlib.NewWriter(&buf)
+	}
+	io.WriteString(w, s)
+	w.Close()
+	return buf.String()
+}
+
+func TestDecodeResponse(t *testing.T) {
+	for _, coding := range []string{"gzip", "deflate"} {
+		body := encode(coding, "body")
+		resp := testResponse(200, map[string]string{
+			"Content-Encoding": coding,
+			"Content-Length":   fmt.Sprint(len(body)),
+		}, body)
+		resp.ContentLength = int64(len(body))
+		if err := decodeResponse(&http.Request{Method: "GET"}, resp); err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if x := readBody(t, resp); x != "body" {
+			t.Errorf("%s: body %q", coding, x)
+		}
+		if _, ok := resp.Header["Content-Encoding"]; ok {
+			t.Errorf("%s: Content-Encoding left in header", coding)
+		}
+		if _, ok := resp.Header["Content-Length"]; ok || resp.ContentLength != -1 {
+			t.Errorf("%s: Content-Length left at %d", coding, resp.ContentLength)
+		}
+	}
+
+	// Codings we don't know, and bodiless responses, are left alone.
+	resp := testResponse(200, map[string]string{"Content-Encoding": "br"}, "xyzzy")
+	decodeResponse(&http.Request{Method: "GET"}, resp)
+	if x := readBody(t, resp); x != "xyzzy" || resp.Header["Content-Encoding"] != "br" {
+		t.Errorf("br: body %q, header %#v", x, resp.Header)
+	}
+	resp = testResponse(200, map[string]string{"Content-Encoding": "gzip"}, "")
+	if err := decodeResponse(&http.Request{Method: "HEAD"}, resp); err != nil {
+		t.Error("unexpected err", err)
+	}
+	if resp.Header["Content-Encoding"] != "gzip" {
+		t.Error("HEAD: Content-Encoding removed")
+	}
+
+	resp = testResponse(200, map[string]string{"Content-Encoding": "gzip"}, "not gzip")
+	if err := decodeResponse(&http.Request{Method: "GET"}, resp); err == nil {
+		t.Error("expected err for bad gzip")
+	}
+}
+
+func TestWithAcceptEncoding(t *testing.T) {
+	req := &http.Request{Header: map[string]string{"X-Pri": "1"}}
+	x := withAcceptEncoding(req)
+	if x.Header["Accept-Encoding"] != acceptEncoding || x.Header["X-Pri"] != "1" {
+		t.Errorf("header %#v", x.Header)
+	}
+	if _, ok := req.Header["Accept-Encoding"]; ok {
+		t.Error("original request changed")
+	}
+}
+
+// Returns a self-signed certificate and key for localhost, in PEM.
+func testCert(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          []byte{1},
+		Subject:               x509.Name{CommonName: "localhost", Organization: []string{"httpc test"}},
+		NotBefore:             time.SecondsToUTC(time.Seconds() - 3600),
+		NotAfter:              time.SecondsToUTC(time.Seconds() + 3600),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	var cbuf, kbuf bytes.Buffer
+	pem.Encode(&cbuf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	pem.Encode(&kbuf, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return cbuf.Bytes(), kbuf.Bytes()
+}
+
+// Starts an https server with a new certificate, and returns its port and
+// the certificate.
+func tlsServer(t *testing.T, body string) (port string, certPEM []byte) {
+	certPEM, keyPEM := testCert(t)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	go http.Serve(l, HandlerString(body))
+	addr := l.Addr().String()
+	return addr[strings.LastIndex(addr, ":")+1:], certPEM
+}
+
+func TestHTTPS(t *testing.T) {
+	port, certPEM := tlsServer(t, "hello tls")
+	roots := tls.NewCASet()
+	roots.SetFromPEM(certPEM)
+	c := NewClientWithOptions(10, 10, ClientOptions{TLSConfig: &tls.Config{RootCAs: roots}})
+
+	resp, err := Send(c, &http.Request{RawURL: "https://localhost:" + port + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello tls" {
+		t.Errorf("expected hello tls, got %q", body)
+	}
+
+	// The certificate is for localhost, not 127.0.0.1.
+	if _, err := Send(c, &http.Request{RawURL: "https://127.0.0.1:" + port + "/"}); err == nil {
+		t.Error("expected err for the wrong host name")
+	}
+
+	// Nor is it signed by anyone the defaults trust.
+	if _, err := Send(NewClient(10, 10), &http.Request{RawURL: "https://localhost:" + port + "/"}); err == nil {
+		t.Error("expected err for an untrusted certificate")
+	}
+}
+
+func TestPoolsByScheme(t *testing.T) {
+	c := NewClient(10, 10).(*client)
+	if c.getPool("http://localhost") == c.getPool("https://localhost") {
+		t.Error("http and https share a pool")
+	}
+	if c.getPool("https://localhost") != c.getPool("https://localhost") {
+		t.Error("expected one pool per scheme and host")
+	}
+	for _, url := range []string{"https://localhost/", "https://localhost:443/a"} {
+		u, _ := http.ParseURL(url)
+		if key := poolKey(u); key != "https://localhost:443" {
+			t.Errorf("%s: pool %s, want https://localhost:443", url, key)
+		}
+	}
+}
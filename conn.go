@@ -1,6 +1,7 @@
 package httpc
 
 import (
+	"crypto/tls"
 	"http"
 	"net"
 	"os"
@@ -9,13 +10,76 @@ import (
 
 func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
 
-func dial(addr string) (*http.ClientConn, os.Error) {
-	if !hasPort(addr) {
-		addr += ":http"
+// Returns the host part of addr, without port or IPv6 brackets.
+func hostOf(addr string) string {
+	if hasPort(addr) {
+		addr = addr[0:strings.LastIndex(addr, ":")]
+	}
+	return strings.TrimRight(strings.TrimLeft(addr, "["), "]")
+}
+
+// Opens a connection to addr, a host with an optional port, for scheme,
+// which is http or https, through proxy, if not nil. For https, the server's
+// certificate is checked against config's roots and against the host name,
+// which is also sent for SNI.
+func dial(scheme, addr string, proxy *http.URL, config *tls.Config) (*http.ClientConn, os.Error) {
+	addr = withPort(scheme, addr)
+	var sock net.Conn
+	var err os.Error
+	if proxy == nil {
+		sock, err = net.Dial("tcp", "", addr)
+	} else {
+		sock, err = dialProxy(scheme, addr, proxy)
 	}
-	sock, err := net.Dial("tcp", "", addr)
 	if err != nil {
 		return nil, err
 	}
+	if scheme == "https" {
+		if sock, err = tlsClient(sock, hostOf(addr), config); err != nil {
+			return nil, err
+		}
+	}
 	return http.NewClientConn(sock, nil), nil
 }
+
+// Connects to addr through the proxy. A SOCKS5 proxy connects us to addr
+// directly. An http proxy, for https, opens a tunnel to addr; plain http
+// requests go to the proxy itself; see proxyRequest.
+func dialProxy(scheme, addr string, proxy *http.URL) (net.Conn, os.Error) {
+	if proxy.Scheme == "socks5" || proxy.Scheme == "socks5h" {
+		return dialSOCKS5(addr, proxy)
+	}
+	if proxy.Scheme != "http" {
+		return nil, os.ErrorString("unsupported proxy scheme " + proxy.Scheme)
+	}
+	sock, err := net.Dial("tcp", "", withPort(proxy.Scheme, proxy.Host))
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "https" {
+		if err = connectTunnel(sock, addr, proxy); err != nil {
+			sock.Close()
+			return nil, err
+		}
+	}
+	return sock, nil
+}
+
+// Runs the TLS handshake over sock, for host, and verifies the server.
+func tlsClient(sock net.Conn, host string, config *tls.Config) (net.Conn, os.Error) {
+	c := new(tls.Config)
+	if config != nil {
+		*c = *config
+	}
+	c.ServerName = host
+	conn := tls.Client(sock, c)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.VerifyHostname(host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -16,10 +16,11 @@
 package httpc
 
 import (
-	"fmt"
+	"bytes"
 	"http"
 	"io"
 	"os"
+	"strings"
 )
 
 // This interface is for sending HTTP requests.
@@ -27,7 +28,7 @@ type Sender interface {
 	Send(*http.Request) (*http.Response, os.Error)
 }
 
-var DefaultSender = NewCache(NewMemoryStore(50000000), NewClient(40, 6))
+var DefaultSender = NewCache(NewCompressedStore(NewMemoryStore(50000000), "gzip"), NewClient(40, 6))
 
 func prepend(r *http.Response, rs []*http.Response) []*http.Response {
 	nrs := make([]*http.Response, len(rs)+1)
@@ -40,6 +41,43 @@ func getHeader(r *http.Request, key string) (value string) {
 	return r.Header[http.CanonicalHeaderKey(key)]
 }
 
+// Splits a comma-separated header value into its trimmed, non-empty elements.
+// Commas inside quoted strings do not split.
+func splitList(s string) []string {
+	return splitQuoted(s, ',')
+}
+
+// Like splitList, but splits on sep.
+func splitQuoted(s string, sep byte) []string {
+	list := make([]string, 0, strings.Count(s, string(sep))+1)
+	quoted := false
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) {
+			if s[i] == '"' {
+				quoted = !quoted
+			}
+			if quoted || s[i] != sep {
+				continue
+			}
+		}
+		if x := strings.TrimSpace(s[start:i]); x != "" {
+			list = list[0 : len(list)+1]
+			list[len(list)-1] = x
+		}
+		start = i + 1
+	}
+	return list
+}
+
+// Appends an element to a comma-separated header value.
+func joinList(list, x string) string {
+	if list == "" {
+		return x
+	}
+	return list + ", " + x
+}
+
 func Send(s Sender, req *http.Request) (resp *http.Response, err os.Error) {
 	if s == nil {
 		s = DefaultSender
@@ -54,35 +92,21 @@ func Send(s Sender, req *http.Request) (resp *http.Response, err os.Error) {
 	return s.Send(req)
 }
 
-// Much like http.Get. If s is nil, uses DefaultSender.
+// Much like http.Get. If s is nil, uses DefaultSender. Follows redirects as
+// DefaultRedirectPolicy says, and returns all responses, the latest first.
 func Get(s Sender, url string) (rs []*http.Response, err os.Error) {
-	for redirect := 0; ; redirect++ {
-		if redirect >= 10 {
-			err = os.ErrorString("stopped after 10 redirects")
-			break
-		}
-
-		var req http.Request
-		req.RawURL = url
-		req.Header = map[string]string{}
-		r, err := Send(s, &req)
-		if err != nil {
-			break
-		}
-		rs = prepend(r, rs)
-		if shouldRedirect(r.StatusCode) {
-			r.Body.Close()
-			if url = r.GetHeader("Location"); url == "" {
-				err = os.ErrorString(fmt.Sprintf("%d response missing Location header", r.StatusCode))
-				break
-			}
-			continue
-		}
+	var req http.Request
+	req.RawURL = url
+	req.Header = map[string]string{}
+	return Follow(s, &req, nil)
+}
 
-		return
+// Sends req, following redirects, and returns the final response.
+func sendFollow(s Sender, req *http.Request) (r *http.Response, err os.Error) {
+	rs, err := Follow(s, req, nil)
+	if len(rs) > 0 {
+		r = rs[0]
 	}
-
-	err = &http.URLError{"Get", url, err}
 	return
 }
 
@@ -95,7 +119,7 @@ func sendBody(s Sender, url, method, bodyType string, body io.Reader) (r *http.R
 		"Content-Type": bodyType,
 	}
 	req.TransferEncoding = []string{"chunked"}
-	return Send(s, &req)
+	return sendFollow(s, &req)
 }
 
 func Put(s Sender, url string, bodyType string, body io.Reader) (r *http.Response, err os.Error) {
@@ -106,12 +130,47 @@ func Post(s Sender, url string, bodyType string, body io.Reader) (r *http.Respon
 	return sendBody(s, url, "POST", bodyType, body)
 }
 
+// Posts form, URL-encoded, as application/x-www-form-urlencoded.
 func PostForm(s Sender, url string, form [][2]string) (r *http.Response, err os.Error) {
-	return
+	return sendBody(s, url, "POST", "application/x-www-form-urlencoded", bytes.NewBufferString(encodeForm(form)))
+}
+
+func Patch(s Sender, url string, bodyType string, body io.Reader) (r *http.Response, err os.Error) {
+	return sendBody(s, url, "PATCH", bodyType, body)
+}
+
+func sendMethod(s Sender, url, method string) (r *http.Response, err os.Error) {
+	var req http.Request
+	req.Method = method
+	req.RawURL = url
+	req.Header = map[string]string{}
+	return sendFollow(s, &req)
 }
 
 func Delete(s Sender, url string) (r *http.Response, err os.Error) {
-	return
+	return sendMethod(s, url, "DELETE")
+}
+
+func Head(s Sender, url string) (r *http.Response, err os.Error) {
+	return sendMethod(s, url, "HEAD")
+}
+
+func Options(s Sender, url string) (r *http.Response, err os.Error) {
+	return sendMethod(s, url, "OPTIONS")
+}
+
+// Encodes form as name=value pairs joined by &, in order.
+func encodeForm(form [][2]string) string {
+	var buf bytes.Buffer
+	for i, kv := range form {
+		if i > 0 {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(http.URLEscape(kv[0]))
+		buf.WriteByte('=')
+		buf.WriteString(http.URLEscape(kv[1]))
+	}
+	return buf.String()
 }
 
 type nopCloser struct {
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 )
 
@@ -110,3 +111,50 @@ func TestPut(t *testing.T) {
 	//resp.Body.Close()
 }
 
+func TestPostForm(t *testing.T) {
+	var ctype, body string
+	s := &funcSender{f: func(req *http.Request) *http.Response {
+		ctype = req.Header["Content-Type"]
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+		return testResponse(200, map[string]string{}, "")
+	}}
+	form := [][2]string{{"q", "a b"}, {"x&y", "1=2"}, {"q", "c"}}
+	if _, err := PostForm(s, "http://localhost/", form); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if ctype != "application/x-www-form-urlencoded" {
+		t.Errorf("wrong content type %q", ctype)
+	}
+	if body != "q=a+b&x%26y=1%3d2&q=c" && body != "q=a+b&x%26y=1%3D2&q=c" {
+		t.Errorf("wrong body %q", body)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	var method string
+	s := &funcSender{f: func(req *http.Request) *http.Response {
+		method = req.Method
+		return testResponse(200, map[string]string{}, "")
+	}}
+	helpers := map[string]func(Sender, string) (*http.Response, os.Error){
+		"DELETE":  Delete,
+		"HEAD":    Head,
+		"OPTIONS": Options,
+		"PATCH": func(s Sender, url string) (*http.Response, os.Error) {
+			return Patch(s, url, "text/plain", bytes.NewBufferString("abc"))
+		},
+	}
+	for want, f := range helpers {
+		r, err := f(s, "http://localhost/")
+		if err != nil {
+			t.Error("unexpected err", err)
+		}
+		if r == nil {
+			t.Fatalf("%s: nil resp", want)
+		}
+		if method != want {
+			t.Errorf("expected %s, got %s", want, method)
+		}
+	}
+}
@@ -13,13 +13,14 @@ import (
 // integer.
 const defaultPri = 5000
 
-// A connection pool for one domain+port.
+// A connection pool for one scheme, domain and port.
 type pool struct {
 	addr    string
+	dial    func() (*poolConn, os.Error)
 	reqs    chan *clientRequest
 	execute chan bool
 	wantPri int
-	conns   chan *http.ClientConn
+	conns   chan *poolConn
 
 	// managed by client driver
 	pri     int
@@ -33,14 +34,18 @@ func (p *pool) exec(r *http.Request) (resp *http.Response, err os.Error) {
 	for {
 		conn := <-conns
 		if conn == nil {
-			conn, err = dial(p.addr)
+			conn, err = p.dial()
 			if err != nil {
 				conns <- nil
 				return
 			}
 		}
 
-		err = conn.Write(r)
+		if conn.prepare != nil {
+			err = conn.Write(conn.prepare(r))
+		} else {
+			err = conn.Write(r)
+		}
 		if err != nil {
 			conn.Close()
 			conns <- nil
@@ -81,6 +86,13 @@ func (p *pool) exec(r *http.Request) (resp *http.Response, err os.Error) {
 	panic("can not happen")
 }
 
+// A connection in a pool, with how requests are to be written on it, which
+// depends on the proxy, if any, it was opened through.
+type poolConn struct {
+	*http.ClientConn
+	prepare func(*http.Request) *http.Request // if not nil, applied before writing
+}
+
 func (p *pool) hookup(cr *clientRequest, decReq chan<- *pool) {
 	defer func() { decReq <- p }()
 
@@ -108,15 +120,16 @@ func (p *pool) accept(incReq, decReq chan<- *pool) {
 	}
 }
 
-func newPool(addr string, limit int, incReq, decReq chan<- *pool) *pool {
+func newPool(addr string, limit int, dial func() (*poolConn, os.Error), incReq, decReq chan<- *pool) *pool {
 	p := &pool{
 		addr:    addr,
+		dial:    dial,
 		pos:     -1,
 		reqs:    make(chan *clientRequest),
 		execute: make(chan bool),
 	}
 
-	p.conns = make(chan *http.ClientConn, limit)
+	p.conns = make(chan *poolConn, limit)
 	for i := 0; i < limit; i++ {
 		p.conns <- nil
 	}
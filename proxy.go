@@ -0,0 +1,139 @@
+package httpc
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"http"
+	"net"
+	"os"
+	"strings"
+)
+
+// Returns the proxy to use for requests to u, from the environment: the
+// variable HTTP_PROXY or HTTPS_PROXY, as the scheme of u calls for, unless
+// the host of u is listed in NO_PROXY. The lower case names are also
+// looked for. NO_PROXY is a comma-separated list of host names, each of
+// which also matches its subdomains, or "*" for all hosts. Requests to
+// localhost are never proxied. It returns nil for no proxy.
+func ProxyFromEnvironment(u *http.URL) (*http.URL, os.Error) {
+	var proxy string
+	switch u.Scheme {
+	case "http":
+		proxy = getenv("HTTP_PROXY", "http_proxy")
+	case "https":
+		proxy = getenv("HTTPS_PROXY", "https_proxy")
+	}
+	if proxy == "" || !useProxy(hostOf(u.Host), getenv("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	if strings.Index(proxy, "://") < 0 {
+		proxy = "http://" + proxy
+	}
+	p, err := http.ParseURL(proxy)
+	if err != nil {
+		return nil, os.ErrorString(fmt.Sprintf("invalid proxy address %q: %s", proxy, err))
+	}
+	return p, nil
+}
+
+// Returns a func for ClientOptions.Proxy that always returns u.
+func ProxyURL(u *http.URL) func(*http.URL) (*http.URL, os.Error) {
+	return func(*http.URL) (*http.URL, os.Error) { return u, nil }
+}
+
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Reports whether a request to host should go through a proxy, given the
+// value of NO_PROXY.
+func useProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.HasPrefix(host, "127.") || host == "::1" {
+		return false
+	}
+	for _, x := range splitList(noProxy) {
+		if x == "*" {
+			return false
+		}
+		x = strings.ToLower(hostOf(x))
+		x = strings.TrimLeft(x, ".")
+		if host == x || strings.HasSuffix(host, "."+x) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns host, with port 80 or 443, as scheme calls for, if it has no port.
+func withPort(scheme, host string) string {
+	if hasPort(host) {
+		return host
+	}
+	if scheme == "https" {
+		return host + ":443"
+	}
+	return host + ":80"
+}
+
+// Returns the value of a Proxy-Authorization header with the user name and
+// password in proxy, or "" if it has none.
+func proxyAuth(proxy *http.URL) string {
+	if proxy.Userinfo == "" {
+		return ""
+	}
+	userinfo, err := http.URLUnescape(proxy.Userinfo)
+	if err != nil {
+		userinfo = proxy.Userinfo
+	}
+	buf := make([]byte, base64.StdEncoding.EncodedLen(len(userinfo)))
+	base64.StdEncoding.Encode(buf, []byte(userinfo))
+	return "Basic " + string(buf)
+}
+
+// Returns a copy of req to send to the http proxy: the request line carries
+// the absolute URI (RFC 9112, section 3.2.2), and the header any
+// credentials for the proxy.
+func proxyRequest(req *http.Request, proxy *http.URL) *http.Request {
+	x := new(http.Request)
+	*x = *req
+	u := new(http.URL)
+	*u = *req.URL
+	u.RawPath = req.URL.Scheme + "://" + req.URL.Host + req.URL.RawPath
+	x.URL = u
+	if auth := proxyAuth(proxy); auth != "" {
+		x.Header = map[string]string{"Proxy-Authorization": auth}
+		for k, v := range req.Header {
+			x.Header[k] = v
+		}
+	}
+	return x
+}
+
+// Asks the proxy at the other end of sock for a tunnel to addr, a host and
+// port.
+func connectTunnel(sock net.Conn, addr string, proxy *http.URL) os.Error {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if auth := proxyAuth(proxy); auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err := sock.Write([]byte(req + "\r\n")); err != nil {
+		return err
+	}
+	// The proxy sends nothing more until we begin the TLS handshake, so
+	// the reader can't take any of it.
+	resp, err := http.ReadResponse(bufio.NewReader(sock), "CONNECT")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return os.ErrorString(fmt.Sprintf("proxy refused CONNECT to %s: %s", addr, resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package httpc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUseProxy(t *testing.T) {
+	var tests = []struct {
+		host, noProxy string
+		want          bool
+	}{
+		{"example.org", "", true},
+		{"localhost", "", false},
+		{"127.0.0.1", "", false},
+		{"example.org", "*", false},
+		{"example.org", "example.com, example.org", false},
+		{"www.example.org", "example.org", false},
+		{"www.example.org", ".example.org", false},
+		{"Example.ORG", "example.org:8080", false},
+		{"notexample.org", "example.org", true},
+	}
+	for _, test := range tests {
+		if got := useProxy(test.host, test.noProxy); got != test.want {
+			t.Errorf("useProxy(%q, %q) = %v, want %v", test.host, test.noProxy, got, test.want)
+		}
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	names := []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"}
+	saved := make([]string, len(names))
+	for i, name := range names {
+		saved[i] = os.Getenv(name)
+		os.Setenv(name, "")
+	}
+	defer func() {
+		for i, name := range names {
+			os.Setenv(name, saved[i])
+		}
+	}()
+	os.Setenv("HTTP_PROXY", "proxy.example.org:3128")
+	os.Setenv("https_proxy", "http://user:pw@secure.example.org:3128")
+	os.Setenv("NO_PROXY", "internal.example.org")
+
+	var tests = []struct {
+		url, want string
+	}{
+		{"http://example.com/", "proxy.example.org:3128"},
+		{"https://example.com/", "secure.example.org:3128"},
+		{"http://internal.example.org/", ""},
+		{"http://localhost:8080/", ""},
+	}
+	for _, test := range tests {
+		u, _ := http.ParseURL(test.url)
+		p, err := ProxyFromEnvironment(u)
+		if err != nil {
+			t.Error("unexpected err", err)
+		}
+		got := ""
+		if p != nil {
+			got = p.Host
+		}
+		if got != test.want {
+			t.Errorf("%s: proxy %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestProxyRequest(t *testing.T) {
+	req := &http.Request{RawURL: "http://example.org/a?b=c", Header: map[string]string{"X-Pri": "1"}}
+	req.URL, _ = http.ParseURL(req.RawURL)
+	proxy, _ := http.ParseURL("http://user:pw@proxy.example.org:3128")
+	x := proxyRequest(req, proxy)
+	if x.URL.RawPath != "http://example.org/a?b=c" {
+		t.Errorf("request URI %q", x.URL.RawPath)
+	}
+	if x.Header["Proxy-Authorization"] != "Basic dXNlcjpwdw==" || x.Header["X-Pri"] != "1" {
+		t.Errorf("header %#v", x.Header)
+	}
+	if req.URL.RawPath != "/a?b=c" || req.Header["Proxy-Authorization"] != "" {
+		t.Error("original request changed")
+	}
+}
+
+// Reads a request line and header, and returns them as lines.
+func readHead(r *bufio.Reader) (lines []string, err os.Error) {
+	lines = make([]string, 0, 10)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return lines, nil
+		}
+		if len(lines) == cap(lines) {
+			x := make([]string, len(lines), 2*cap(lines))
+			copy(x, lines)
+			lines = x
+		}
+		lines = lines[0 : len(lines)+1]
+		lines[len(lines)-1] = line
+	}
+	panic("can not happen")
+}
+
+// Starts a proxy that handles one connection with f, and returns its URL.
+func testProxy(t *testing.T, f func(c net.Conn, r *bufio.Reader)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		f(c, bufio.NewReader(c))
+	}()
+	return "http://user:pw@" + l.Addr().String()
+}
+
+func TestHTTPProxy(t *testing.T) {
+	seen := make(chan []string, 1)
+	proxy := testProxy(t, func(c net.Conn, r *bufio.Reader) {
+		head, _ := readHead(r)
+		seen <- head
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nproxy")
+	})
+	p, _ := http.ParseURL(proxy)
+	c := NewClientWithOptions(10, 10, ClientOptions{Proxy: ProxyURL(p)})
+
+	resp, err := Send(c, &http.Request{RawURL: "http://origin.invalid/a?b=c"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "proxy" {
+		t.Errorf("expected the proxy's answer, got %q", body)
+	}
+	head := <-seen
+	if len(head) == 0 || head[0] != "GET http://origin.invalid/a?b=c HTTP/1.1" {
+		t.Errorf("request line %q", head)
+	}
+	if !contains(head, "Proxy-Authorization: Basic dXNlcjpwdw==") {
+		t.Errorf("no Proxy-Authorization in %q", head)
+	}
+}
+
+func TestConnectProxy(t *testing.T) {
+	port, certPEM := tlsServer(t, "hello tls")
+	seen := make(chan []string, 1)
+	proxy := testProxy(t, func(c net.Conn, r *bufio.Reader) {
+		head, _ := readHead(r)
+		seen <- head
+		origin, err := net.Dial("tcp", "", "127.0.0.1:"+port)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer origin.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(origin, r)
+		io.Copy(c, origin)
+	})
+	p, _ := http.ParseURL(proxy)
+	roots := tls.NewCASet()
+	roots.SetFromPEM(certPEM)
+	c := NewClientWithOptions(10, 10, ClientOptions{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Proxy:     ProxyURL(p),
+	})
+
+	resp, err := Send(c, &http.Request{RawURL: "https://localhost:" + port + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello tls" {
+		t.Errorf("expected hello tls, got %q", body)
+	}
+	head := <-seen
+	if len(head) == 0 || head[0] != "CONNECT localhost:"+port+" HTTP/1.1" {
+		t.Errorf("request line %q", head)
+	}
+	if !contains(head, "Proxy-Authorization: Basic dXNlcjpwdw==") {
+		t.Errorf("no Proxy-Authorization in %q", head)
+	}
+}
+
+func contains(list []string, x string) bool {
+	for _, y := range list {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// The proxy is looked up for each connection, so a failed lookup doesn't
+// stick to the pool.
+func TestProxyPerDial(t *testing.T) {
+	calls := 0
+	fail := os.NewError("no proxy yet")
+	c := NewClientWithOptions(10, 10, ClientOptions{Proxy: func(u *http.URL) (*http.URL, os.Error) {
+		calls++
+		if calls == 1 {
+			return nil, fail
+		}
+		return nil, nil
+	}})
+	if _, err := Send(c, &http.Request{RawURL: "http://localhost:" + port + "/"}); err != fail {
+		t.Errorf("expected err from Proxy, got %v", err)
+	}
+	resp, err := Send(c, &http.Request{RawURL: "http://localhost:" + port + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello" {
+		t.Errorf("expected hello, got %q", body)
+	}
+	if calls != 2 {
+		t.Errorf("expected Proxy called twice, got %d", calls)
+	}
+}
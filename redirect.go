@@ -0,0 +1,154 @@
+package httpc
+
+import (
+	"bytes"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Says how to follow redirects.
+type RedirectPolicy struct {
+	// The most redirects to follow for one request. Going beyond is an
+	// error. If zero, redirects are not followed at all, and come back as
+	// they are.
+	MaxHops int
+
+	// If not nil, called before following each redirect, with the request
+	// about to be sent and the responses so far, the latest first. If it
+	// returns an error, the redirect is not followed, and Follow returns
+	// that error.
+	CheckRedirect func(req *http.Request, via []*http.Response) os.Error
+}
+
+// Used by Get, Post, Put and the other helpers.
+var DefaultRedirectPolicy = &RedirectPolicy{MaxHops: 10}
+
+// The largest request body Follow keeps a copy of to send again.
+const maxReplayBody = 64 << 10
+
+// Headers that only the origin they were meant for may see.
+var credentialHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// Sends req with s, following redirects as policy says, and returns the
+// responses, the latest first. The body of every response but the latest has
+// been closed. If policy is nil, uses DefaultRedirectPolicy.
+//
+// A 303 is followed with a GET, as is a 301 or 302 to a POST. Other
+// redirects keep the method and body. Up to maxReplayBody bytes of the body
+// are read ahead; if that is all of it, a copy is kept in memory so that it
+// can be sent again. A bigger body is streamed, and a redirect that would
+// send it again is not followed, but comes back as it is.
+func Follow(s Sender, req *http.Request, policy *RedirectPolicy) (rs []*http.Response, err os.Error) {
+	if policy == nil {
+		policy = DefaultRedirectPolicy
+	}
+	var body []byte
+	streamed := req.Body != nil
+	if req.Body != nil && policy.MaxHops > 0 {
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxReplayBody+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, &http.URLError{valueOrDefault(req.Method, "GET"), req.RawURL, err}
+		}
+		if len(body) > maxReplayBody {
+			req.Body = &readAhead{bytes.NewBuffer(body), req.Body}
+			body = nil
+		} else {
+			req.Body.Close()
+			req.Body = nopCloser{bytes.NewBuffer(body)}
+			streamed = false
+		}
+	}
+
+	url := req.RawURL
+	for hop := 0; ; hop++ {
+		op := valueOrDefault(req.Method, "GET")
+		r, err := Send(s, req)
+		if err != nil {
+			return rs, &http.URLError{op, url, err}
+		}
+		rs = prepend(r, rs)
+		if !shouldRedirect(r.StatusCode) || policy.MaxHops == 0 {
+			return rs, nil
+		}
+		if streamed && req.Body != nil && keepsBody(req.Method, r.StatusCode) {
+			// The body has been sent, and there is no copy to send again.
+			return rs, nil
+		}
+		r.Body.Close()
+		if hop >= policy.MaxHops {
+			err = os.ErrorString(fmt.Sprintf("stopped after %d redirects", policy.MaxHops))
+			return rs, &http.URLError{op, url, err}
+		}
+		location := r.GetHeader("Location")
+		if location == "" {
+			err = os.ErrorString(fmt.Sprintf("%d response missing Location header", r.StatusCode))
+			return rs, &http.URLError{op, url, err}
+		}
+
+		next := redirectRequest(req, r.StatusCode, resolveURL(url, location), body)
+		if policy.CheckRedirect != nil {
+			if err = policy.CheckRedirect(next, rs); err != nil {
+				return rs, &http.URLError{op, url, err}
+			}
+		}
+		req, url = next, next.RawURL
+	}
+	panic("can not happen")
+}
+
+// Returns the request to send to url, after a response with the given
+// status to req.
+func redirectRequest(req *http.Request, status int, url string, body []byte) *http.Request {
+	next := &http.Request{
+		Method:           req.Method,
+		RawURL:           url,
+		Header:           map[string]string{},
+		TransferEncoding: req.TransferEncoding,
+	}
+	for k, v := range req.Header {
+		next.Header[k] = v
+	}
+	if urlOrigin(url) != urlOrigin(req.RawURL) {
+		for _, k := range credentialHeaders {
+			next.Header[k] = "", false
+		}
+	}
+
+	if !keepsBody(req.Method, status) {
+		next.Method = "GET"
+		next.TransferEncoding = nil
+		next.Header["Content-Type"] = "", false
+		next.Header["Content-Length"] = "", false
+		return next
+	}
+	if req.Body != nil {
+		next.Body = nopCloser{bytes.NewBuffer(body)}
+		next.ContentLength = req.ContentLength
+	}
+	return next
+}
+
+// Whether a redirect with the given status to a request with the given method
+// is followed with the same method and body.
+func keepsBody(method string, status int) bool {
+	return !(status == 303 && method != "HEAD" || (status == 301 || status == 302) && method == "POST")
+}
+
+// Reads what was read ahead of a body, then the rest of it.
+type readAhead struct {
+	buf *bytes.Buffer
+	rc  io.ReadCloser
+}
+
+func (r *readAhead) Read(p []byte) (int, os.Error) {
+	if r.buf.Len() > 0 {
+		return r.buf.Read(p)
+	}
+	return r.rc.Read(p)
+}
+
+func (r *readAhead) Close() os.Error { return r.rc.Close() }
@@ -0,0 +1,178 @@
+package httpc
+
+import (
+	"bytes"
+	"http"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Records what each request looked like when it reached the sender.
+type sentRequest struct {
+	method, url, body string
+	header            map[string]string
+}
+
+// Answers with the responses in order, recording the requests.
+func redirectSender(sent *[]sentRequest, resps ...*http.Response) *funcSender {
+	return &funcSender{f: func(req *http.Request) *http.Response {
+		var body []byte
+		if req.Body != nil {
+			body, _ = ioutil.ReadAll(req.Body)
+		}
+		x := *sent
+		x = x[0 : len(x)+1]
+		x[len(x)-1] = sentRequest{req.Method, req.RawURL, string(body), req.Header}
+		*sent = x
+		return resps[len(x)-1]
+	}}
+}
+
+func redirect(code int, location string) *http.Response {
+	return testResponse(code, map[string]string{"Location": location}, "")
+}
+
+func TestFollow(t *testing.T) {
+	var tests = []struct {
+		method   string
+		code     int
+		want     string // method of the second request
+		wantBody string
+	}{
+		{"POST", 301, "GET", ""},
+		{"POST", 302, "GET", ""},
+		{"POST", 303, "GET", ""},
+		{"PUT", 303, "GET", ""},
+		{"HEAD", 303, "HEAD", "data"},
+		{"PUT", 302, "PUT", "data"},
+		{"POST", 307, "POST", "data"},
+		{"POST", 308, "POST", "data"},
+	}
+	for _, test := range tests {
+		sent := make([]sentRequest, 0, 2)
+		s := redirectSender(&sent, redirect(test.code, "../b?x=1"), testResponse(200, map[string]string{}, "done"))
+		req := &http.Request{
+			Method: test.method,
+			RawURL: "http://localhost/a/b",
+			Header: map[string]string{"Content-Type": "text/plain"},
+			Body:   nopCloser{bytes.NewBufferString("data")},
+		}
+		rs, err := Follow(s, req, nil)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if len(rs) != 2 || rs[0].StatusCode != 200 || rs[1].StatusCode != test.code {
+			t.Errorf("%s %d: got %d responses", test.method, test.code, len(rs))
+		}
+		if sent[0].body != "data" {
+			t.Errorf("%s %d: first body %q", test.method, test.code, sent[0].body)
+		}
+		got := sent[1]
+		if got.url != "http://localhost/b?x=1" {
+			t.Errorf("%s %d: redirected to %s", test.method, test.code, got.url)
+		}
+		if got.method != test.want || got.body != test.wantBody {
+			t.Errorf("%s %d: sent %s with body %q, want %s with %q", test.method, test.code, got.method, got.body, test.want, test.wantBody)
+		}
+		if _, ok := got.header["Content-Type"]; ok != (test.wantBody != "") {
+			t.Errorf("%s %d: Content-Type %q", test.method, test.code, got.header["Content-Type"])
+		}
+	}
+}
+
+// A body too big to keep a copy of is streamed, so only redirects that drop
+// it are followed.
+func TestFollowStreamedBody(t *testing.T) {
+	data := strings.Repeat("x", maxReplayBody+1)
+	for _, code := range []int{303, 307, 308} {
+		sent := make([]sentRequest, 0, 2)
+		s := redirectSender(&sent, redirect(code, "/b"), testResponse(200, map[string]string{}, "done"))
+		req := &http.Request{
+			Method:           "POST",
+			RawURL:           "http://localhost/a",
+			Header:           map[string]string{},
+			Body:             nopCloser{bytes.NewBufferString(data)},
+			ContentLength:    -1,
+			TransferEncoding: []string{"chunked"},
+		}
+		rs, err := Follow(s, req, nil)
+		if err != nil {
+			t.Fatal("unexpected err", err)
+		}
+		if sent[0].body != data {
+			t.Errorf("%d: first body of %d bytes, want %d", code, len(sent[0].body), len(data))
+		}
+		if code == 303 {
+			if len(rs) != 2 || rs[0].StatusCode != 200 || sent[1].method != "GET" {
+				t.Errorf("%d: expected a GET to be followed", code)
+			}
+		} else if len(rs) != 1 || rs[0].StatusCode != code || len(sent) != 1 {
+			t.Errorf("%d: expected the redirect itself, sent %d", code, len(sent))
+		}
+	}
+}
+
+func TestFollowMaxHops(t *testing.T) {
+	sent := make([]sentRequest, 0, 3)
+	s := redirectSender(&sent, redirect(302, "/1"), redirect(302, "/2"), redirect(302, "/3"))
+	rs, err := Follow(s, &http.Request{RawURL: "http://localhost/"}, &RedirectPolicy{MaxHops: 2})
+	if err == nil {
+		t.Error("expected err after 2 hops")
+	}
+	if len(rs) != 3 {
+		t.Errorf("expected 3 responses, got %d", len(rs))
+	}
+
+	sent = make([]sentRequest, 0, 1)
+	s = redirectSender(&sent, redirect(302, "/1"))
+	rs, err = Follow(s, &http.Request{RawURL: "http://localhost/"}, &RedirectPolicy{})
+	if err != nil {
+		t.Error("unexpected err", err)
+	}
+	if len(rs) != 1 || rs[0].StatusCode != 302 {
+		t.Error("expected the redirect itself")
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	sent := make([]sentRequest, 0, 2)
+	s := redirectSender(&sent, redirect(302, "http://example.org/"), testResponse(200, map[string]string{}, ""))
+	stop := os.NewError("off site")
+	policy := &RedirectPolicy{MaxHops: 10, CheckRedirect: func(req *http.Request, via []*http.Response) os.Error {
+		if urlOrigin(req.RawURL) != "http://localhost" {
+			return stop
+		}
+		return nil
+	}}
+	rs, err := Follow(s, &http.Request{RawURL: "http://localhost/"}, policy)
+	if err == nil || err.(*http.URLError).Error != stop {
+		t.Errorf("expected err from CheckRedirect, got %v", err)
+	}
+	if len(rs) != 1 || len(sent) != 1 {
+		t.Errorf("expected to stop after 1 request, sent %d", len(sent))
+	}
+}
+
+// Credentials don't follow a redirect to another origin.
+func TestRedirectCredentials(t *testing.T) {
+	sent := make([]sentRequest, 0, 3)
+	s := redirectSender(&sent,
+		redirect(302, "/same"),
+		redirect(302, "http://example.org/other"),
+		testResponse(200, map[string]string{}, ""))
+	req := &http.Request{RawURL: "http://localhost/", Header: map[string]string{"Authorization": "Basic eDp5", "Cookie": "a=b"}}
+	if _, err := Follow(s, req, nil); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if sent[1].header["Authorization"] == "" || sent[1].header["Cookie"] == "" {
+		t.Error("expected credentials kept on the same origin")
+	}
+	if _, ok := sent[2].header["Authorization"]; ok {
+		t.Error("expected Authorization dropped for another origin")
+	}
+	if _, ok := sent[2].header["Cookie"]; ok {
+		t.Error("expected Cookie dropped for another origin")
+	}
+}
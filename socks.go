@@ -0,0 +1,176 @@
+package httpc
+
+import (
+	"fmt"
+	"http"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SOCKS version 5 (RFC 1928), with user name and password authentication
+// (RFC 1929).
+const (
+	socksVersion  = 5
+	socksNoAuth   = 0
+	socksUserPass = 2
+	socksConnect  = 1
+	socksIPv4     = 1
+	socksDomain   = 3
+	socksIPv6     = 4
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Connects to addr, a host and port, through the SOCKS5 proxy, logging in
+// with the user name and password in proxy, if any, when the proxy asks for
+// it. Host names are passed on for the proxy to resolve, rather than looked
+// up here, whether the proxy's scheme is socks5 or socks5h.
+func dialSOCKS5(addr string, proxy *http.URL) (net.Conn, os.Error) {
+	host, port := hostOf(addr), addr[strings.LastIndex(addr, ":")+1:]
+	portnum, err := strconv.Atoi(port)
+	if err != nil || portnum < 1 || portnum > 0xffff {
+		return nil, os.ErrorString("socks: bad port " + port)
+	}
+	proxyAddr := proxy.Host
+	if !hasPort(proxyAddr) {
+		proxyAddr += ":1080"
+	}
+	sock, err := net.Dial("tcp", "", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = socksHandshake(sock, host, portnum, proxy.Userinfo); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+func socksHandshake(sock net.Conn, host string, port int, userinfo string) os.Error {
+	// With a login to offer, the server may still not want one.
+	methods := []byte{socksVersion, 1, socksNoAuth}
+	if userinfo != "" {
+		methods = []byte{socksVersion, 2, socksNoAuth, socksUserPass}
+	}
+	if _, err := sock.Write(methods); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(sock, buf); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return os.ErrorString(fmt.Sprintf("socks: unexpected version %d", buf[0]))
+	}
+	switch {
+	case buf[1] == socksNoAuth:
+	case buf[1] == socksUserPass && userinfo != "":
+		if err := socksLogin(sock, userinfo); err != nil {
+			return err
+		}
+	default:
+		return os.ErrorString("socks: no acceptable authentication method")
+	}
+
+	req := make([]byte, 0, 6+256)
+	req = req[0:4]
+	req[0], req[1], req[2] = socksVersion, socksConnect, 0
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return os.ErrorString("socks: host name too long")
+		}
+		req[3] = socksDomain
+		req = req[0 : len(req)+1]
+		req[len(req)-1] = byte(len(host))
+		req = req[0 : len(req)+len(host)]
+		copy(req[len(req)-len(host):], host)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req[3] = socksIPv4
+		req = req[0 : len(req)+4]
+		copy(req[len(req)-4:], ip4)
+	} else {
+		req[3] = socksIPv6
+		req = req[0 : len(req)+16]
+		copy(req[len(req)-16:], ip)
+	}
+	req = req[0 : len(req)+2]
+	req[len(req)-2], req[len(req)-1] = byte(port>>8), byte(port)
+	if _, err := sock.Write(req); err != nil {
+		return err
+	}
+
+	// The reply: version, status, reserved, then the address the proxy
+	// bound, which we have no use for.
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(sock, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		msg := "unknown error"
+		if int(reply[1]) < len(socksReplies) {
+			msg = socksReplies[reply[1]]
+		}
+		return os.ErrorString("socks: connect failed: " + msg)
+	}
+	var n int
+	switch reply[3] {
+	case socksIPv4:
+		n = 4
+	case socksIPv6:
+		n = 16
+	case socksDomain:
+		if _, err := io.ReadFull(sock, reply[0:1]); err != nil {
+			return err
+		}
+		n = int(reply[0])
+	default:
+		return os.ErrorString(fmt.Sprintf("socks: unexpected address type %d", reply[3]))
+	}
+	_, err := io.ReadFull(sock, make([]byte, n+2))
+	return err
+}
+
+// Sends the user name and password in userinfo, a "user:password" string
+// as found in a URL.
+func socksLogin(sock net.Conn, userinfo string) os.Error {
+	if x, err := http.URLUnescape(userinfo); err == nil {
+		userinfo = x
+	}
+	user, password := userinfo, ""
+	if i := strings.Index(userinfo, ":"); i >= 0 {
+		user, password = userinfo[0:i], userinfo[i+1:]
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return os.ErrorString("socks: user name or password too long")
+	}
+	req := make([]byte, 3+len(user)+len(password))
+	req[0] = 1 // the version of the subnegotiation
+	req[1] = byte(len(user))
+	copy(req[2:], user)
+	req[2+len(user)] = byte(len(password))
+	copy(req[3+len(user):], password)
+	if _, err := sock.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(sock, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return os.ErrorString("socks: login refused")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package httpc
+
+import (
+	"crypto/tls"
+	"http"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+// What a client asked the stand-in SOCKS5 server for.
+type socksRequest struct {
+	user, password, host string
+	port                 int
+}
+
+// Starts a stand-in SOCKS5 server that handles one connection, accepting
+// only the login user:pw, or, if login is false, asking for no login at all.
+// It connects every request to 127.0.0.1, at the port asked for, and reports
+// what it was asked for on seen.
+func testSOCKS5(t *testing.T, seen chan socksRequest, login bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var r socksRequest
+		defer func() { seen <- r }()
+
+		buf := make([]byte, 256)
+		read := func(n int) []byte {
+			if _, err := io.ReadFull(c, buf[0:n]); err != nil {
+				return nil
+			}
+			return buf[0:n]
+		}
+		b := read(2)
+		if b == nil || b[0] != 5 {
+			return
+		}
+		want := byte(0)
+		if login {
+			want = 2
+		}
+		offered := false
+		for _, m := range read(int(b[1])) {
+			offered = offered || m == want
+		}
+		if !offered {
+			c.Write([]byte{5, 0xff})
+			return
+		}
+		c.Write([]byte{5, want})
+		if login {
+			if b := read(2); b == nil || b[0] != 1 {
+				return
+			} else if b = read(int(b[1])); b != nil {
+				r.user = string(b)
+			}
+			if b := read(1); b != nil {
+				if b = read(int(b[0])); b != nil {
+					r.password = string(b)
+				}
+			}
+			if r.user != "user" || r.password != "pw" {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+
+		if b := read(4); b == nil || b[1] != 1 || b[3] != 3 {
+			c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		if b := read(1); b != nil {
+			if b = read(int(b[0])); b != nil {
+				r.host = string(b)
+			}
+		}
+		if b := read(2); b != nil {
+			r.port = int(b[0])<<8 | int(b[1])
+		}
+		origin, err := net.Dial("tcp", "", "127.0.0.1:"+strconv.Itoa(r.port))
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer origin.Close()
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		go io.Copy(origin, c)
+		io.Copy(c, origin)
+	}()
+	return l.Addr().String()
+}
+
+func TestSOCKS5(t *testing.T) {
+	seen := make(chan socksRequest, 1)
+	proxy, _ := http.ParseURL("socks5://user:pw@" + testSOCKS5(t, seen, true))
+	c := NewClientWithOptions(10, 10, ClientOptions{Proxy: ProxyURL(proxy)})
+
+	// The name is left for the proxy to look up.
+	resp, err := Send(c, &http.Request{RawURL: "http://origin.invalid:" + port + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello" {
+		t.Errorf("expected hello, got %q", body)
+	}
+	r := <-seen
+	if r.host != "origin.invalid" || strconv.Itoa(r.port) != port {
+		t.Errorf("proxy asked for %s:%d", r.host, r.port)
+	}
+}
+
+func TestSOCKS5HTTPS(t *testing.T) {
+	tlsPort, certPEM := tlsServer(t, "hello tls")
+	seen := make(chan socksRequest, 1)
+	proxy, _ := http.ParseURL("socks5://user:pw@" + testSOCKS5(t, seen, true))
+	roots := tls.NewCASet()
+	roots.SetFromPEM(certPEM)
+	c := NewClientWithOptions(10, 10, ClientOptions{
+		TLSConfig: &tls.Config{RootCAs: roots},
+		Proxy:     ProxyURL(proxy),
+	})
+
+	resp, err := Send(c, &http.Request{RawURL: "https://localhost:" + tlsPort + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello tls" {
+		t.Errorf("expected hello tls, got %q", body)
+	}
+	if r := <-seen; r.host != "localhost" {
+		t.Errorf("proxy asked for %s", r.host)
+	}
+}
+
+func TestSOCKS5BadLogin(t *testing.T) {
+	seen := make(chan socksRequest, 1)
+	proxy, _ := http.ParseURL("socks5://user:wrong@" + testSOCKS5(t, seen, true))
+	c := NewClientWithOptions(10, 10, ClientOptions{Proxy: ProxyURL(proxy)})
+	if _, err := Send(c, &http.Request{RawURL: "http://origin.invalid:" + port + "/"}); err == nil {
+		t.Error("expected err for a refused login")
+	}
+	if r := <-seen; r.host != "" {
+		t.Errorf("expected no connect after a refused login, got %s", r.host)
+	}
+}
+
+// A login is offered, but the proxy needn't take it.
+func TestSOCKS5NoLogin(t *testing.T) {
+	seen := make(chan socksRequest, 1)
+	proxy, _ := http.ParseURL("socks5://user:pw@" + testSOCKS5(t, seen, false))
+	c := NewClientWithOptions(10, 10, ClientOptions{Proxy: ProxyURL(proxy)})
+	resp, err := Send(c, &http.Request{RawURL: "http://origin.invalid:" + port + "/"})
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	if body := readBody(t, resp); body != "hello" {
+		t.Errorf("expected hello, got %q", body)
+	}
+	if r := <-seen; r.user != "" || r.host != "origin.invalid" {
+		t.Errorf("proxy got user %q and asked for %s", r.user, r.host)
+	}
+}
@@ -0,0 +1,139 @@
+package httpc
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Records, in the info of a compressed entry, the codec its content was
+// compressed with. Entries without it are stored as they are.
+const infoCodec = "httpc.codec"
+
+type compressedStore struct {
+	s     Store
+	codec string
+}
+
+// Stores responses in s, with their content compressed by codec, which is
+// "gzip" or "deflate". Entries s already holds uncompressed, or compressed
+// by the other codec, still load. Content that already has a
+// Content-Encoding is stored as it is.
+func NewCompressedStore(s Store, codec string) Store {
+	if codec != "gzip" && codec != "deflate" {
+		panic("httpc: unknown codec " + codec)
+	}
+	return &compressedStore{s, codec}
+}
+
+func (s *compressedStore) Get(key string) (map[string]string, io.ReadCloser) {
+	info, content := s.s.Get(key)
+	if info == nil {
+		return nil, nil
+	}
+	codec, ok := info[infoCodec]
+	if !ok {
+		return info, content
+	}
+	var r io.ReadCloser
+	switch codec {
+	case "gzip":
+		gr, err := gzip.NewReader(content)
+		if err != nil {
+			content.Close()
+			return nil, nil
+		}
+		r = gr
+	case "deflate":
+		r = flate.NewReader(content)
+	default:
+		content.Close()
+		return nil, nil
+	}
+	plain := map[string]string{}
+	for k, v := range info {
+		if k != infoCodec {
+			plain[k] = v
+		}
+	}
+	return plain, &decompressor{r, content}
+}
+
+func (s *compressedStore) Set(key string, info map[string]string, content []byte) {
+	w := s.Create(key, info)
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return
+	}
+	w.Commit()
+}
+
+func (s *compressedStore) Delete(key string) {
+	s.s.Delete(key)
+}
+
+func (s *compressedStore) Create(key string, info map[string]string) StoreWriter {
+	if e := info["Content-Encoding"]; e != "" && e != "identity" {
+		return s.s.Create(key, info)
+	}
+	x := map[string]string{infoCodec: s.codec}
+	for k, v := range info {
+		x[k] = v
+	}
+	w := &compressor{w: s.s.Create(key, x)}
+	w.c, w.err = newCompressor(s.codec, w.w)
+	return w
+}
+
+func newCompressor(codec string, w io.Writer) (io.WriteCloser, os.Error) {
+	if codec == "gzip" {
+		return gzip.NewWriter(w)
+	}
+	return flate.NewWriter(w, flate.DefaultCompression), nil
+}
+
+// Compresses what is written to it into a StoreWriter.
+type compressor struct {
+	w   StoreWriter
+	c   io.WriteCloser
+	err os.Error
+}
+
+func (w *compressor) Write(p []byte) (int, os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.c.Write(p)
+	w.err = err
+	return n, err
+}
+
+func (w *compressor) Commit() {
+	if w.err == nil {
+		w.err = w.c.Close()
+	}
+	if w.err != nil {
+		w.w.Abort()
+		return
+	}
+	w.w.Commit()
+}
+
+func (w *compressor) Abort() {
+	w.w.Abort()
+}
+
+type decompressor struct {
+	r       io.ReadCloser
+	content io.ReadCloser
+}
+
+func (d *decompressor) Read(p []byte) (int, os.Error) {
+	return d.r.Read(p)
+}
+
+func (d *decompressor) Close() os.Error {
+	d.r.Close()
+	return d.content.Close()
+}
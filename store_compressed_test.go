@@ -0,0 +1,65 @@
+package httpc
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressed(t *testing.T) {
+	body := strings.Repeat(`{"name": "value"}, `, 100)
+	for _, codec := range []string{"gzip", "deflate"} {
+		mem := NewMemoryStore(10000)
+		s := NewCompressedStore(mem, codec)
+		s.Set("a", map[string]string{"Etag": "x"}, []byte(body))
+
+		info, content := mem.Get("a")
+		if info == nil {
+			t.Fatalf("%s: expected info, got nil", codec)
+		}
+		if info[infoCodec] != codec {
+			t.Errorf("%s: expected codec recorded, got %#v", codec, info)
+		}
+		if x, _ := ioutil.ReadAll(content); len(x) >= len(body)/3 {
+			t.Errorf("%s: expected compressed content, got %d bytes", codec, len(x))
+		}
+
+		info, _ = s.Get("a")
+		if _, ok := info[infoCodec]; ok || info["Etag"] != "x" {
+			t.Errorf("%s: expected plain info, got %#v", codec, info)
+		}
+		wantContent(t, s, "a", body)
+
+		w := s.Create("b", map[string]string{})
+		w.Write([]byte(body[0:10]))
+		w.Write([]byte(body[10:]))
+		w.Commit()
+		wantContent(t, s, "b", body)
+	}
+}
+
+func TestCompressedMixed(t *testing.T) {
+	mem := NewMemoryStore(10000)
+	mem.Set("old", map[string]string{}, []byte("plain"))
+	NewCompressedStore(mem, "deflate").Set("deflated", map[string]string{}, []byte("deflated"))
+	s := NewCompressedStore(mem, "gzip")
+	wantContent(t, s, "old", "plain")
+	wantContent(t, s, "deflated", "deflated")
+
+	// Already encoded content is left alone.
+	s.Set("encoded", map[string]string{"Content-Encoding": "br"}, []byte("xyzzy"))
+	wantContent(t, mem, "encoded", "xyzzy")
+
+	mem.Set("unknown", map[string]string{infoCodec: "lzw"}, []byte("xyzzy"))
+	wantMissing(t, s, "unknown")
+}
+
+// More fits in a store of the same size.
+func TestCompressedFits(t *testing.T) {
+	body := strings.Repeat("<p>paragraph</p>\n", 100)
+	s := NewCompressedStore(NewMemoryStore(len(body)), "gzip")
+	s.Set("a", map[string]string{}, []byte(body))
+	s.Set("b", map[string]string{}, []byte(body))
+	wantContent(t, s, "a", body)
+	wantContent(t, s, "b", body)
+}
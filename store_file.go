@@ -1,7 +1,454 @@
 package httpc
 
-// This will eventually be a cache that stores responses on disk. It is currently a stub.
-func NewFileStore(path string, maxBytes int) Store {
-	return nil
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The first line of every entry file. Files that don't start with it are
+// not ours, or not finished, and are treated as missing.
+//
+// Next comes the key, quoted as by strconv.Quote so that it fits on one line
+// (secondary keys of Vary variants have newlines in them), then the info,
+// a "Name: value" line each, then a blank line, and then the content.
+const fileMagic = "httpc-cache 2\n"
+
+// Entries are written here, then renamed into place when complete, so
+// readers only ever open whole files.
+const fileTmpDir = "tmp"
+
+// Every process using the directory holds an exclusive flock on this file
+// while it changes the directory: renaming entries into place, deleting
+// them, or cleaning up.
+const fileLock = "lock"
+
+// Holds the number of bytes the entries take up between them, in decimal,
+// kept up to date by every store with the lock held.
+const fileSize = "size"
+
+// The lock on a directory, shared by all stores in this process that use it,
+// so that each directory costs one open file, however many stores are made.
+type dirLock struct {
+	mu sync.Mutex // serializes use of f within this process
+	f  *os.File
+}
+
+var (
+	dirLocksMu sync.Mutex
+	dirLocks   = map[string]*dirLock{}
+)
+
+// Returns the lock on dir, opening its lock file if need be.
+func openDirLock(dir string) (*dirLock, os.Error) {
+	dirLocksMu.Lock()
+	defer dirLocksMu.Unlock()
+	name := path.Join(dir, fileLock)
+	l, ok := dirLocks[dir]
+	if ok && sameFile(l.f, name) {
+		return l, nil
+	}
+	f, err := os.Open(name, os.O_RDWR|os.O_CREAT, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// The directory was removed and made again since.
+		l.mu.Lock()
+		l.f.Close()
+		l.f = f
+		l.mu.Unlock()
+		return l, nil
+	}
+	l = &dirLock{f: f}
+	dirLocks[dir] = l
+	return l, nil
+}
+
+// Reports whether f is still the file called name.
+func sameFile(f *os.File, name string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(name)
+	return err == nil && cur.Dev == fi.Dev && cur.Ino == fi.Ino
+}
+
+// Several stores, in this process or others, may share a directory. The
+// directory itself is the index: sizes come from the files, and the order
+// of access from their access times, which Get sets explicitly. Only the
+// total size is kept apart, in the size file, so that writing an entry
+// needn't look at all the others. When that total goes over budget, or is
+// missing, eviction rescans the directory, and sets it right again.
+type fileStore struct {
+	dir      string
+	maxBytes int64
+	lock     *dirLock
 }
 
+// Stores responses in files under the directory path, using at most maxBytes
+// of disk space between them, and evicting the least recently accessed first.
+// The entries survive the process, and are found again by a store opened on
+// the same directory later. Stores in several processes may share the
+// directory at once.
+//
+// If the directory can't be set up, the store stores nothing.
+func NewFileStore(dir string, maxBytes int) Store {
+	dir = path.Clean(dir)
+	if err := os.MkdirAll(path.Join(dir, fileTmpDir), 0700); err != nil {
+		return nullStore{}
+	}
+	lock, err := openDirLock(dir)
+	if err != nil {
+		return nullStore{}
+	}
+	s := &fileStore{dir: dir, maxBytes: int64(maxBytes), lock: lock}
+
+	s.acquire()
+	defer s.release()
+	// Anything left in tmp that nobody holds a lock on was being written
+	// when its process died.
+	fis, _ := ioutil.ReadDir(s.path(fileTmpDir))
+	for _, fi := range fis {
+		name := path.Join(s.path(fileTmpDir), fi.Name)
+		f, err := os.Open(name, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(f.Fd(), syscall.LOCK_EX|syscall.LOCK_NB) == 0 {
+			os.Remove(name)
+		}
+		f.Close()
+	}
+	s.evict()
+	return s
+}
+
+func (s *fileStore) path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+// Locks the directory against other stores, here and in other processes.
+func (s *fileStore) acquire() {
+	s.lock.mu.Lock()
+	syscall.Flock(s.lock.f.Fd(), syscall.LOCK_EX)
+}
+
+func (s *fileStore) release() {
+	syscall.Flock(s.lock.f.Fd(), syscall.LOCK_UN)
+	s.lock.mu.Unlock()
+}
+
+// The methods below are called with the directory locked.
+
+// Returns the total recorded in the size file, or -1 if there is none.
+func (s *fileStore) used() int64 {
+	b, err := ioutil.ReadFile(s.path(fileSize))
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi64(strings.TrimSpace(string(b)))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+func (s *fileStore) setUsed(n int64) {
+	ioutil.WriteFile(s.path(fileSize), []byte(strconv.Itoa64(n)+"\n"), 0600)
+}
+
+// Adds delta bytes to the total, evicting if that takes it over budget.
+func (s *fileStore) account(delta int64) {
+	n := s.used()
+	if n < 0 || n+delta < 0 || n+delta > s.maxBytes {
+		s.evict()
+		return
+	}
+	s.setUsed(n + delta)
+}
+
+// Removes the entry file name, if it is the file fi, or any file if fi is
+// nil, and takes it off the total.
+func (s *fileStore) remove(name string, fi *os.FileInfo) {
+	cur, err := os.Stat(s.path(name))
+	if err != nil || fi != nil && (cur.Dev != fi.Dev || cur.Ino != fi.Ino) {
+		return
+	}
+	if os.Remove(s.path(name)) == nil {
+		s.account(-cur.Size)
+	}
+}
+
+type byAtime []*os.FileInfo
+
+func (a byAtime) Len() int           { return len(a) }
+func (a byAtime) Less(i, j int) bool { return a[i].Atime_ns < a[j].Atime_ns }
+func (a byAtime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// Rescans the directory and records the total. If that is over maxBytes, it
+// deletes the least recently accessed files until the rest fit in 90% of it,
+// so that the next rescan is some way off.
+func (s *fileStore) evict() {
+	fis, _ := ioutil.ReadDir(s.dir)
+	var used int64
+	entries := fis[0:0]
+	for _, fi := range fis {
+		if fi.IsRegular() && fi.Name != fileLock && fi.Name != fileSize {
+			entries = entries[0 : len(entries)+1]
+			entries[len(entries)-1] = fi
+			used += fi.Size
+		}
+	}
+	if used > s.maxBytes {
+		low := s.maxBytes - s.maxBytes/10
+		sort.Sort(byAtime(entries))
+		for _, fi := range entries {
+			if used <= low {
+				break
+			}
+			if os.Remove(s.path(fi.Name)) == nil {
+				used -= fi.Size
+			}
+		}
+	}
+	s.setUsed(used)
+}
+
+// Reads the header of an entry file: the key it belongs to, and its info.
+func readEntryHeader(r *bufio.Reader) (key string, info map[string]string, ok bool) {
+	magic, err := r.ReadString('\n')
+	if err != nil || magic != fileMagic {
+		return
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if key, err = strconv.Unquote(line[0 : len(line)-1]); err != nil {
+		return "", nil, false
+	}
+	info = map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", nil, false
+		}
+		if line == "\n" {
+			return key, info, true
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return "", nil, false
+		}
+		info[line[0:i]] = line[i+2 : len(line)-1]
+	}
+	panic("can not happen")
+}
+
+type fileReader struct {
+	r *bufio.Reader
+	f *os.File
+}
+
+func (x *fileReader) Read(p []byte) (int, os.Error) { return x.r.Read(p) }
+
+func (x *fileReader) Close() os.Error { return x.f.Close() }
+
+func (s *fileStore) Get(key string) (map[string]string, io.ReadCloser) {
+	name := safeName(key)
+	f, err := os.Open(s.path(name), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil
+	}
+	r := bufio.NewReader(f)
+	fkey, info, ok := readEntryHeader(r)
+	if !ok {
+		// Corrupt. Nobody can use it, so make room, unless somebody
+		// has put a good one in its place meanwhile.
+		f.Close()
+		s.acquire()
+		defer s.release()
+		s.remove(name, fi)
+		return nil, nil
+	}
+	if fkey != key {
+		// A different key with the same name.
+		f.Close()
+		return nil, nil
+	}
+	os.Chtimes(s.path(name), time.Nanoseconds(), fi.Mtime_ns)
+	return info, &fileReader{r, f}
+}
+
+func (s *fileStore) Set(key string, info map[string]string, content []byte) {
+	w := s.Create(key, info)
+	if _, err := w.Write(content); err != nil {
+		w.Abort()
+		return
+	}
+	w.Commit()
+}
+
+func (s *fileStore) Delete(key string) {
+	s.acquire()
+	defer s.release()
+	s.remove(safeName(key), nil)
+}
+
+type fileWriter struct {
+	s    *fileStore
+	name string
+	f    *os.File
+	n    int64
+	err  os.Error
+}
+
+func (s *fileStore) Create(key string, info map[string]string) StoreWriter {
+	w := &fileWriter{s: s, name: safeName(key)}
+	// Lock the temporary file for as long as it's open, so that a
+	// store starting up elsewhere doesn't take it for one left behind.
+	s.acquire()
+	w.f, w.err = ioutil.TempFile(s.path(fileTmpDir), "entry")
+	if w.err == nil {
+		if e := syscall.Flock(w.f.Fd(), syscall.LOCK_EX); e != 0 {
+			w.err = os.Errno(e)
+		}
+	}
+	s.release()
+	if w.err != nil {
+		w.Abort()
+		return w
+	}
+	var buf bytes.Buffer
+	buf.WriteString(fileMagic)
+	buf.WriteString(strconv.Quote(key) + "\n")
+	for k, v := range info {
+		fmt.Fprintf(&buf, "%s: %s\n", k, v)
+	}
+	buf.WriteString("\n")
+	w.Write(buf.Bytes())
+	return w
+}
+
+func (w *fileWriter) Write(p []byte) (int, os.Error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.n+int64(len(p)) > w.s.maxBytes {
+		w.err = errTooBig
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *fileWriter) Commit() {
+	if w.err != nil {
+		w.Abort()
+		return
+	}
+	if err := w.f.Sync(); err != nil {
+		w.Abort()
+		return
+	}
+	s := w.s
+	s.acquire()
+	defer s.release()
+	var replaced int64
+	if fi, err := os.Stat(s.path(w.name)); err == nil {
+		replaced = fi.Size
+	}
+	if err := os.Rename(w.f.Name(), s.path(w.name)); err != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		return
+	}
+	t := time.Nanoseconds()
+	os.Chtimes(s.path(w.name), t, t)
+	w.f.Close()
+	s.account(w.n - replaced)
+}
+
+func (w *fileWriter) Abort() {
+	if w.f != nil {
+		os.Remove(w.f.Name())
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// Returns a file name for key. It starts with a readable version of the key,
+// without the scheme, and with characters that are unsafe in file names
+// replaced by commas. After that comes an MD5 of the whole key, to keep names
+// unique, even when the readable part is cut short.
+func safeName(key string) string {
+	h := md5.New()
+	io.WriteString(h, key)
+
+	name := key
+	if i := strings.Index(name, "://"); i > 0 && validScheme(name[0:i]) {
+		name = name[i+3:]
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if unsafeNameChar(c) {
+			c = ','
+			for i+1 < len(name) && unsafeNameChar(name[i+1]) {
+				i++
+			}
+		}
+		buf.WriteByte(c)
+	}
+	if buf.Len() > 200 {
+		buf.Truncate(200)
+	}
+	return fmt.Sprintf("%s,%x", buf.String(), h.Sum())
+}
+
+func unsafeNameChar(c byte) bool {
+	switch c {
+	case '?', '/', ':', '|', '\\', '*', '"', '<', '>':
+		return true
+	}
+	return c < ' ' || c == 0x7f
+}
+
+// Stores nothing; for a file store whose directory can't be used.
+type nullStore struct{}
+
+func (nullStore) Set(key string, info map[string]string, content []byte) {}
+
+func (nullStore) Get(key string) (map[string]string, io.ReadCloser) { return nil, nil }
+
+func (nullStore) Delete(key string) {}
+
+func (nullStore) Create(key string, info map[string]string) StoreWriter { return nullWriter{} }
+
+type nullWriter struct{}
+
+func (nullWriter) Write(p []byte) (int, os.Error) { return 0, errTooBig }
+
+func (nullWriter) Commit() {}
+
+func (nullWriter) Abort() {}
@@ -1,28 +1,326 @@
+package httpc
 
-// const (
-// 	x200 = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
-// 	x201 = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
-// )
-// 
-// func TestUrlSafename(tt *testing.T) {
-// 	t := (*T)(tt)
-// 
-// 	// Test that different URIs end up generating different safe names
-// 	t.assertEQ("example.org,fred,a=b,58489f63a7a83c3b7794a6a398ee8b1f", safeName("http://example.org/fred/?a=b"))
-// 	t.assertEQ("example.org,fred,a=b,8c5946d56fec453071f43329ff0be46b", safeName("http://example.org/fred?/a=b"))
-// 	t.assertEQ("www.example.org,fred,a=b,499c44b8d844a011b67ea2c015116968", safeName("http://www.example.org/fred?/a=b"))
-// 	t.assertEQ("www.example.org,fred,a=b,692e843a333484ce0095b070497ab45d", safeName("https://www.example.org/fred?/a=b"))
-// 	t.assertNE(safeName("http://www"), safeName("https://www"))
-// 
-// 	// Test the max length limits
-// 	uri := "http://" + x200 + ".org"
-// 	uri2 := "http://" + x201 + ".org"
-// 	t.assertNE(safeName(uri2), safeName(uri))
-// 	// Max length should be 200 + 1 (",") + 32
-// 	t.want(233 == len(safeName(uri)), "max len 233, but got %d", len(safeName(uri)))
-// 	t.want(233 == len(safeName(uri2)), "max len 233, but got %d", len(safeName(uri2)))
-// 
-// 	// Unicode
-// 	t.assertEQ("xn--http,-4y1d.org,fred,a=b,579924c35db315e5a32e3d9963388193", safeName("http://\u2304.org/fred/?a=b"))
-// }
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
 
+const (
+	x200 = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
+	x201 = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
+)
+
+func TestUrlSafename(tt *testing.T) {
+	t := (*T)(tt)
+
+	// Test that different URIs end up generating different safe names
+	t.assertEQ("example.org,fred,a=b,58489f63a7a83c3b7794a6a398ee8b1f", safeName("http://example.org/fred/?a=b"), "")
+	t.assertEQ("example.org,fred,a=b,8c5946d56fec453071f43329ff0be46b", safeName("http://example.org/fred?/a=b"), "")
+	t.assertEQ("www.example.org,fred,a=b,499c44b8d844a011b67ea2c015116968", safeName("http://www.example.org/fred?/a=b"), "")
+	t.assertEQ("www.example.org,fred,a=b,692e843a333484ce0095b070497ab45d", safeName("https://www.example.org/fred?/a=b"), "")
+	t.assertNE(safeName("http://www"), safeName("https://www"))
+
+	// Test the max length limits
+	uri := "http://" + x200 + ".org"
+	uri2 := "http://" + x201 + ".org"
+	t.assertNE(safeName(uri2), safeName(uri))
+	// Max length should be 200 + 1 (",") + 32
+	t.want(233 == len(safeName(uri)), "max len 233, but got %d", len(safeName(uri)))
+	t.want(233 == len(safeName(uri2)), "max len 233, but got %d", len(safeName(uri2)))
+
+	// Unicode host names are kept as they are, not IDNA-encoded as httplib2 does.
+	name := safeName("http://\u2304.org/fred/?a=b")
+	t.want(strings.HasPrefix(name, "\u2304.org,fred,a=b,"), "the host as it is, got %q", name)
+}
+
+var tempDirs = 0
+
+// Returns a new, empty directory, to be removed by the caller.
+func tempDir(t *testing.T) string {
+	tmp := os.Getenv("TMPDIR")
+	if tmp == "" {
+		tmp = "/tmp"
+	}
+	tempDirs++
+	dir := path.Join(tmp, fmt.Sprintf("httpc-test-%d-%d", os.Getpid(), tempDirs))
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	return dir
+}
+
+func wantContent(t *testing.T, s Store, key, body string) {
+	info, content := s.Get(key)
+	if info == nil {
+		t.Errorf("%s: expected info, got nil", key)
+		return
+	}
+	x, err := ioutil.ReadAll(content)
+	content.Close()
+	if err != nil {
+		t.Error("unexpected err", err)
+	}
+	if string(x) != body {
+		t.Errorf("%s: expected body %#v, got %#v", key, body, string(x))
+	}
+}
+
+func wantMissing(t *testing.T, s Store, key string) {
+	info, content := s.Get(key)
+	if info != nil {
+		content.Close()
+		t.Errorf("%s: expected nil info, got %#v", key, info)
+	}
+}
+
+func TestFileSet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 1000)
+	s.Set("http://example.org/a", map[string]string{"Etag": "x"}, []byte("body"))
+	info, _ := s.Get("http://example.org/a")
+	if info == nil || info["Etag"] != "x" {
+		t.Errorf("expected info with Etag, got %#v", info)
+	}
+	wantContent(t, s, "http://example.org/a", "body")
+	s.Delete("http://example.org/a")
+	wantMissing(t, s, "http://example.org/a")
+}
+
+func TestFileLimit(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 30)
+	s.Set("a", map[string]string{}, []byte("long body that doesn't fit"))
+	wantMissing(t, s, "a")
+}
+
+// Each entry below takes len(fileMagic) + len(`"a"\n`) + len("\n") +
+// len("body1") = 24 bytes. Two fit in 90% of 55, after evicting.
+func TestFileReplacement(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 55)
+	s.Set("a", map[string]string{}, []byte("body1"))
+	s.Set("b", map[string]string{}, []byte("body2"))
+	wantContent(t, s, "a", "body1") // a is now the most recently used
+	s.Set("c", map[string]string{}, []byte("body3"))
+	wantMissing(t, s, "b")
+	wantContent(t, s, "a", "body1")
+	wantContent(t, s, "c", "body3")
+}
+
+func TestFileReopen(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 1000)
+	w := s.Create("a", map[string]string{})
+	w.Write([]byte("bo"))
+	w.Write([]byte("dy"))
+	w.Commit()
+	w = s.Create("b", map[string]string{})
+	w.Write([]byte("unfinished"))
+	// The process dies before committing b, which releases its lock.
+	w.(*fileWriter).f.Close()
+
+	s = NewFileStore(dir, 1000)
+	wantContent(t, s, "a", "body")
+	wantMissing(t, s, "b")
+	if fis, _ := ioutil.ReadDir(path.Join(dir, fileTmpDir)); len(fis) != 0 {
+		t.Errorf("expected partial writes cleaned up, got %d files", len(fis))
+	}
+}
+
+func TestFileCorrupt(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 1000)
+	ioutil.WriteFile(path.Join(dir, safeName("a")), []byte("garbage"), 0600)
+	wantMissing(t, s, "a")
+	if _, err := os.Stat(path.Join(dir, safeName("a"))); err == nil {
+		t.Error("expected corrupt file removed")
+	}
+}
+
+func TestFileShared(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s1 := NewFileStore(dir, 1000)
+	s2 := NewFileStore(dir, 1000)
+	s1.Set("a", map[string]string{}, []byte("body"))
+	wantContent(t, s2, "a", "body")
+	s2.Delete("a")
+	wantMissing(t, s1, "a")
+}
+
+// Each store alone stays under the limit, but not both together.
+func TestFileSharedReplacement(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s1 := NewFileStore(dir, 55)
+	s2 := NewFileStore(dir, 55)
+	s1.Set("a", map[string]string{}, []byte("body1"))
+	s2.Set("b", map[string]string{}, []byte("body2"))
+	wantContent(t, s2, "a", "body1")
+	s1.Set("c", map[string]string{}, []byte("body3"))
+	wantMissing(t, s1, "b")
+	wantContent(t, s2, "a", "body1")
+	wantContent(t, s2, "c", "body3")
+}
+
+// A store starting up must not clean away another store's write in progress.
+func TestFileSharedStartup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s1 := NewFileStore(dir, 1000)
+	w := s1.Create("a", map[string]string{})
+	w.Write([]byte("bo"))
+	s2 := NewFileStore(dir, 1000)
+	w.Write([]byte("dy"))
+	w.Commit()
+	wantContent(t, s2, "a", "body")
+}
+
+// Readers see one whole entry or another, never a mix.
+func TestFileSharedTorn(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	const n = 1 << 16
+	bodies := [][]byte{make([]byte, n), make([]byte, n)}
+	for i := range bodies[1] {
+		bodies[1][i] = 'x'
+	}
+	w := NewFileStore(dir, 1<<20)
+	w.Set("a", map[string]string{}, bodies[0])
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			w.Set("a", map[string]string{}, bodies[i%2])
+		}
+		done <- true
+	}()
+	for i := 0; i < 4; i++ {
+		go func() {
+			r := NewFileStore(dir, 1<<20)
+			for j := 0; j < 50; j++ {
+				info, content := r.Get("a")
+				if info == nil {
+					t.Error("expected info, got nil")
+					continue
+				}
+				x, err := ioutil.ReadAll(content)
+				content.Close()
+				if err != nil {
+					t.Error("unexpected err", err)
+				}
+				if string(x) != string(bodies[0]) && string(x) != string(bodies[1]) {
+					t.Errorf("torn read of %d bytes", len(x))
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+}
+
+// Secondary keys of Vary variants have newlines in them.
+func TestFileVariantKey(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 1000)
+	key := variantKey("http://example.org/", []string{"Accept-Language"}, map[string]string{"Accept-Language": "en"})
+	s.Set(key, map[string]string{"Etag": "x"}, []byte("body"))
+	info, _ := s.Get(key)
+	if info == nil {
+		t.Fatal("expected info, got nil")
+	}
+	if len(info) != 1 || info["Etag"] != "x" {
+		t.Errorf("expected just the Etag in info, got %#v", info)
+	}
+	wantContent(t, s, key, "body")
+	wantMissing(t, s, "http://example.org/")
+}
+
+func usedBytes(t *testing.T, dir string) string {
+	b, err := ioutil.ReadFile(path.Join(dir, fileSize))
+	if err != nil {
+		t.Fatal("unexpected err", err)
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// The total is kept without rescanning, and set right when it's off.
+func TestFileSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 50)
+	if n := usedBytes(t, dir); n != "0" {
+		t.Errorf("expected 0 bytes used, got %s", n)
+	}
+	s.Set("a", map[string]string{}, []byte("body1"))
+	s.Set("b", map[string]string{}, []byte("body2"))
+	if n := usedBytes(t, dir); n != "48" {
+		t.Errorf("expected 48 bytes used, got %s", n)
+	}
+	s.Set("a", map[string]string{}, []byte("body3"))
+	s.Delete("b")
+	if n := usedBytes(t, dir); n != "24" {
+		t.Errorf("expected 24 bytes used, got %s", n)
+	}
+
+	ioutil.WriteFile(path.Join(dir, fileSize), []byte("1000\n"), 0600)
+	s.Set("c", map[string]string{}, []byte("body4"))
+	if n := usedBytes(t, dir); n != "48" {
+		t.Errorf("expected 48 bytes used after a rescan, got %s", n)
+	}
+	wantContent(t, s, "a", "body3")
+}
+
+// Once over budget, the store evicts down to 90% of it, so the next entries
+// fit without another rescan.
+func TestFileLowWater(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s := NewFileStore(dir, 100)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		s.Set(key, map[string]string{}, []byte("body1"))
+	}
+	wantMissing(t, s, "a")
+	wantMissing(t, s, "b")
+	if n := usedBytes(t, dir); n != "72" {
+		t.Errorf("expected 72 bytes used, got %s", n)
+	}
+	s.Set("f", map[string]string{}, []byte("body1"))
+	if n := usedBytes(t, dir); n != "96" {
+		t.Errorf("expected 96 bytes used, got %s", n)
+	}
+	wantContent(t, s, "c", "body1")
+}
+
+func TestFileSharedLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s1 := NewFileStore(dir, 1000).(*fileStore)
+	s2 := NewFileStore(dir+"/", 1000).(*fileStore)
+	if s1.lock != s2.lock {
+		t.Error("expected stores on one directory to share its lock file")
+	}
+}
+
+func TestFileUnusable(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "file")
+	ioutil.WriteFile(file, []byte{}, 0600)
+	s := NewFileStore(file, 1000)
+	s.Set("a", map[string]string{}, []byte("body"))
+	wantMissing(t, s, "a")
+}
@@ -1,66 +1,199 @@
 package httpc
 
 import (
+	"bytes"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync"
 )
 
 type entry struct {
 	key string
 	info map[string]string
 	content []byte
-	prev, next *entry
+	size int
 }
 
-type memoryStore struct {
-	maxBytes, usedBytes int
+// Each shard holds some of the entries, with its own lock and its own
+// policy. Keys are spread over the shards by hash.
+type memoryShard struct {
+	mu sync.Mutex
 	entries map[string]*entry
-	order entry
+	policy EvictionPolicy
+}
+
+// The shards share one budget of maxBytes. A shard is only ever locked one at
+// a time, and usedMu only ever inside a shard's lock.
+type memoryStore struct {
+	maxBytes int
+	shards []*memoryShard
+
+	usedMu sync.Mutex
+	usedBytes int
 }
 
-// Stores responses in a map with bounded size and LRU replacement.
+const (
+	maxShards = 16
+	minShardBytes = 1 << 20 // smaller stores get fewer shards
+)
+
+// Stores responses in a map with bounded size and LRU replacement. It is
+// safe for concurrent use. Any one response can take up to the whole of
+// maxBytes.
 func NewMemoryStore(maxBytes int) Store {
-	ms := memoryStore{maxBytes:maxBytes, entries:map[string]*entry{}}
-	ms.order.next = &ms.order
-	ms.order.prev = &ms.order
-	return &ms
+	return NewMemoryStorePolicy(maxBytes, NewLRUPolicy)
+}
+
+// Like NewMemoryStore, but with the policy returned by newPolicy choosing
+// what to store and what to evict. The store may be split into shards, each
+// with a policy of its own.
+func NewMemoryStorePolicy(maxBytes int, newPolicy func() EvictionPolicy) Store {
+	n := maxBytes / minShardBytes
+	if n > maxShards {
+		n = maxShards
+	}
+	if n < 1 {
+		n = 1
+	}
+	ms := &memoryStore{maxBytes:maxBytes, shards:make([]*memoryShard, n)}
+	for i := range ms.shards {
+		ms.shards[i] = &memoryShard{
+			entries:map[string]*entry{},
+			policy:newPolicy(),
+		}
+	}
+	return ms
+}
+
+// The number of bytes an entry takes up, counting its key and info as well
+// as its content.
+func entrySize(key string, info map[string]string, content []byte) int {
+	n := len(key) + len(content)
+	for k, v := range info {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+func (s *memoryStore) shard(key string) *memoryShard {
+	return s.shards[crc32.ChecksumIEEE([]byte(key)) % uint32(len(s.shards))]
+}
+
+// Adds delta to the bytes in use, and returns the new total.
+func (s *memoryStore) addUsed(delta int) int {
+	s.usedMu.Lock()
+	defer s.usedMu.Unlock()
+	s.usedBytes += delta
+	return s.usedBytes
 }
 
 func (s *memoryStore) Set(key string, info map[string]string, content []byte) {
-	if len(content) > s.maxBytes {
+	size := entrySize(key, info, content)
+	sh := s.shard(key)
+	sh.mu.Lock()
+	if size > s.maxBytes {
+		s.remove(sh, key)
+		sh.mu.Unlock()
 		return
 	}
-
-	for len(content) > s.maxBytes - s.usedBytes {
-		s.Delete(s.order.prev.key)
+	// A new version of an entry already stored, such as one refreshed
+	// after a 304, replaces it without having to be admitted again.
+	if _, ok := sh.entries[key]; !ok && s.addUsed(0) + size > s.maxBytes {
+		if victim, ok := sh.policy.Victim(); ok && !sh.policy.Admit(key, size, victim) {
+			sh.mu.Unlock()
+			return
+		}
 	}
+	s.remove(sh, key)
+	sh.entries[key] = &entry{key, info, content, size}
+	s.addUsed(size)
+	sh.policy.Add(key, size)
+	sh.mu.Unlock()
 
-	e := &entry{key, info, content, &s.order, s.order.next}
-	e.next.prev = e
-	s.order.next = e
-	s.entries[key] = e
-	s.usedBytes += len(content)
+	s.shrink(sh, key)
 }
 
-func (s memoryStore) Get(key string) (map[string]string, io.ReadCloser) {
-	entry, ok := s.entries[key]
+// Evicts entries until the store fits in maxBytes, from shard first, as far
+// as it can, and then from the others in turn. The entry under key, just
+// stored in first, is left alone.
+func (s *memoryStore) shrink(first *memoryShard, key string) {
+	for i := -1; i < len(s.shards) && s.addUsed(0) > s.maxBytes; {
+		sh := first
+		if i >= 0 {
+			sh = s.shards[i]
+		}
+		sh.mu.Lock()
+		victim, ok := sh.policy.Victim()
+		if ok && (victim != key || sh != first) {
+			s.remove(sh, victim)
+		} else {
+			ok = false
+		}
+		sh.mu.Unlock()
+		if !ok {
+			i++
+		}
+	}
+}
+
+func (s *memoryStore) Get(key string) (map[string]string, io.ReadCloser) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.policy.Touch(key)
+	e, ok := sh.entries[key]
 	if !ok {
 		return nil, nil
 	}
-	return entry.info, &stringReadCloser{entry.content, 0}
+	return e.info, &stringReadCloser{e.content, 0}
 }
 
 func (s *memoryStore) Delete(key string) {
-	e, ok := s.entries[key]
+	sh := s.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	s.remove(sh, key)
+}
+
+// Call with sh.mu held.
+func (s *memoryStore) remove(sh *memoryShard, key string) {
+	e, ok := sh.entries[key]
 	if !ok {
 		return
 	}
-	s.usedBytes -= len(e.content)
-	s.entries[key] = nil, false
-	e.prev.next = e.next
-	e.next.prev = e.prev
+	s.addUsed(-e.size)
+	sh.entries[key] = nil, false
+	sh.policy.Remove(key)
+}
+
+var errTooBig = os.NewError("entry too big for store")
+
+type memoryWriter struct {
+	s    *memoryStore
+	key  string
+	info map[string]string
+	size int // of key and info
+	buf  bytes.Buffer
+}
+
+func (s *memoryStore) Create(key string, info map[string]string) StoreWriter {
+	return &memoryWriter{s: s, key: key, info: info, size: entrySize(key, info, nil)}
+}
+
+func (w *memoryWriter) Write(p []byte) (int, os.Error) {
+	if w.size+w.buf.Len()+len(p) > w.s.maxBytes {
+		return 0, errTooBig
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Commit() {
+	w.s.Set(w.key, w.info, w.buf.Bytes())
 }
 
+func (w *memoryWriter) Abort() {}
+
 type stringReadCloser struct {
 	buf []byte
 	off int
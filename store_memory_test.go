@@ -1,6 +1,7 @@
 package httpc
 
 import (
+	"fmt"
 	"io/ioutil"
 	"testing"
 )
@@ -71,3 +72,121 @@ func TestReplacement(t *testing.T) {
 	}
 }
 
+func TestCreate(t *testing.T) {
+	s := NewMemoryStore(7)
+	w := s.Create("a", map[string]string{})
+	w.Write([]byte("bo"))
+	w.Write([]byte("dy"))
+	if info, _ := s.Get("a"); info != nil {
+		t.Error("expected nil info before commit")
+	}
+	w.Commit()
+	info, content := s.Get("a")
+	if info == nil {
+		t.Fatal("expected info, got nil")
+	}
+	x, err := ioutil.ReadAll(content)
+	if err != nil {
+		t.Error("unexpected err", err)
+	}
+	if string(x) != "body" {
+		t.Errorf("expected body %#v, got %#v", "body", string(x))
+	}
+
+	w = s.Create("b", map[string]string{})
+	w.Write([]byte("body"))
+	w.Abort()
+	if info, _ := s.Get("b"); info != nil {
+		t.Error("expected nil info after abort")
+	}
+
+	w = s.Create("c", map[string]string{})
+	if _, err := w.Write([]byte("long body that doesn't fit")); err == nil {
+		t.Error("expected err writing too much")
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	s := NewMemoryStore(10)
+	s.Set("a", map[string]string{}, []byte("bod1"))
+	s.Set("b", map[string]string{}, []byte("bod2"))
+	s.Get("a") // a is now the most recently used
+	s.Set("c", map[string]string{}, []byte("bod3"))
+	if info, _ := s.Get("b"); info != nil {
+		t.Errorf("expected b evicted, got %#v", info)
+	}
+	if info, _ := s.Get("a"); info == nil {
+		t.Error("expected a kept, got nil")
+	}
+}
+
+func TestSetExisting(t *testing.T) {
+	s := NewMemoryStore(10)
+	s.Set("a", map[string]string{}, []byte("bod1"))
+	s.Set("a", map[string]string{}, []byte("bod2"))
+	s.Set("b", map[string]string{}, []byte("bod3"))
+	if info, _ := s.Get("a"); info == nil {
+		t.Error("expected a kept, got nil")
+	}
+	s.Delete("a")
+	s.Delete("b")
+	if used := s.(*memoryStore).usedBytes; used != 0 {
+		t.Errorf("expected 0 bytes used, got %d", used)
+	}
+}
+
+// Run with the race detector.
+func TestConcurrent(t *testing.T) {
+	s := NewMemoryStore(64 << 20)
+	done := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			for j := 0; j < 1000; j++ {
+				key := fmt.Sprintf("http://example.org/%d", (i*j)%50)
+				s.Set(key, map[string]string{}, []byte(key))
+				if _, content := s.Get(key); content != nil {
+					ioutil.ReadAll(content)
+					content.Close()
+				}
+				if j%7 == 0 {
+					s.Delete(key)
+				}
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+
+	ms := s.(*memoryStore)
+	used := 0
+	for _, sh := range ms.shards {
+		for _, e := range sh.entries {
+			used += e.size
+		}
+	}
+	if used != ms.usedBytes {
+		t.Errorf("expected %d bytes used, got %d", used, ms.usedBytes)
+	}
+}
+
+// The shards share the budget, so one response can take up all of it.
+func TestLargeObject(t *testing.T) {
+	const max = 64 << 20
+	s := NewMemoryStore(max)
+	if n := len(s.(*memoryStore).shards); n < 2 {
+		t.Fatalf("expected several shards, got %d", n)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint(i), map[string]string{}, make([]byte, 1<<20))
+	}
+	big := make([]byte, max/2)
+	s.Set("big", map[string]string{}, big)
+	if info, _ := s.Get("big"); info == nil {
+		t.Error("expected big stored")
+	}
+	if used := s.(*memoryStore).usedBytes; used > max {
+		t.Errorf("expected at most %d bytes used, got %d", max, used)
+	}
+}
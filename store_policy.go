@@ -0,0 +1,259 @@
+package httpc
+
+import (
+	"container/heap"
+	"hash/crc32"
+)
+
+// An EvictionPolicy decides which entries a memory store keeps when it runs
+// out of room. The store calls it with its lock held, so a policy needs no
+// locking of its own, and keys it's told about are always distinct.
+type EvictionPolicy interface {
+	// Records a request for key, whether or not it is stored.
+	Touch(key string)
+
+	// Records that key has been stored, taking size bytes.
+	Add(key string, size int)
+
+	// Records that key has been removed.
+	Remove(key string)
+
+	// Returns the key to evict next, if any.
+	Victim() (key string, ok bool)
+
+	// Reports whether key, of size bytes, is worth storing, if storing it
+	// means evicting victim.
+	Admit(key string, size int, victim string) bool
+}
+
+type lruEntry struct {
+	key        string
+	prev, next *lruEntry
+}
+
+type lruPolicy struct {
+	entries map[string]*lruEntry
+	order   lruEntry // most recently used first
+}
+
+// Returns a policy that evicts the least recently used entry, and admits
+// everything.
+func NewLRUPolicy() EvictionPolicy {
+	p := &lruPolicy{entries: map[string]*lruEntry{}}
+	p.order.next = &p.order
+	p.order.prev = &p.order
+	return p
+}
+
+func (p *lruPolicy) pushFront(e *lruEntry) {
+	e.prev = &p.order
+	e.next = p.order.next
+	e.next.prev = e
+	p.order.next = e
+}
+
+func (p *lruPolicy) unlink(e *lruEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+}
+
+func (p *lruPolicy) Touch(key string) {
+	if e, ok := p.entries[key]; ok {
+		p.unlink(e)
+		p.pushFront(e)
+	}
+}
+
+func (p *lruPolicy) Add(key string, size int) {
+	e := &lruEntry{key: key}
+	p.pushFront(e)
+	p.entries[key] = e
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		p.unlink(e)
+		p.entries[key] = nil, false
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	if p.order.prev == &p.order {
+		return "", false
+	}
+	return p.order.prev.key, true
+}
+
+func (p *lruPolicy) Admit(key string, size int, victim string) bool {
+	return true
+}
+
+type gdsEntry struct {
+	key   string
+	size  int
+	h     float64
+	index int
+}
+
+type gdsHeap []*gdsEntry
+
+func (h *gdsHeap) Len() int           { return len(*h) }
+func (h *gdsHeap) Less(i, j int) bool { return (*h)[i].h < (*h)[j].h }
+
+func (h *gdsHeap) Swap(i, j int) {
+	a := *h
+	a[i], a[j] = a[j], a[i]
+	a[i].index = i
+	a[j].index = j
+}
+
+func (h *gdsHeap) Push(x interface{}) {
+	a := *h
+	if len(a) == cap(a) {
+		b := make([]*gdsEntry, len(a), 2*len(a)+1)
+		copy(b, a)
+		a = b
+	}
+	a = a[0 : len(a)+1]
+	e := x.(*gdsEntry)
+	e.index = len(a) - 1
+	a[e.index] = e
+	*h = a
+}
+
+func (h *gdsHeap) Pop() interface{} {
+	a := *h
+	e := a[len(a)-1]
+	*h = a[0 : len(a)-1]
+	return e
+}
+
+// GreedyDual-Size, as in Cao and Irani, "Cost-Aware WWW Proxy Caching
+// Algorithms", with a cost of 1 for every entry.
+type gdsPolicy struct {
+	entries map[string]*gdsEntry
+	heap    gdsHeap
+	l       float64 // the inflation value: h of the last victim
+	victim  string
+}
+
+// Returns a policy that evicts by GreedyDual-Size, which prefers to keep
+// small entries and recently used ones, so that one large entry doesn't push
+// out many small ones. It admits everything.
+func NewGreedyDualSizePolicy() EvictionPolicy {
+	return &gdsPolicy{entries: map[string]*gdsEntry{}}
+}
+
+func (p *gdsPolicy) Touch(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		e.h = p.l + 1/float64(e.size)
+		heap.Push(&p.heap, e)
+	}
+}
+
+func (p *gdsPolicy) Add(key string, size int) {
+	if size < 1 {
+		size = 1
+	}
+	e := &gdsEntry{key: key, size: size, h: p.l + 1/float64(size)}
+	heap.Push(&p.heap, e)
+	p.entries[key] = e
+}
+
+func (p *gdsPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		p.entries[key] = nil, false
+		if key == p.victim {
+			p.l = e.h
+			p.victim = ""
+		}
+	}
+}
+
+func (p *gdsPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	p.victim = p.heap[0].key
+	return p.victim, true
+}
+
+func (p *gdsPolicy) Admit(key string, size int, victim string) bool {
+	return true
+}
+
+const (
+	sketchDepth = 4
+	sketchWidth = 1 << 12
+	sketchMax   = 15 // counters saturate here, as with 4 bits
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A count-min sketch of how often keys were requested recently. Once it has
+// seen sketchWidth*10 requests, all counts are halved, so that old
+// popularity fades.
+type sketch struct {
+	counts    [sketchDepth][sketchWidth]uint8
+	additions int
+}
+
+func (s *sketch) index(key string, i int) int {
+	h1 := crc32.ChecksumIEEE([]byte(key))
+	h2 := crc32.Checksum([]byte(key), castagnoli)
+	return int((h1 + uint32(i)*h2) % sketchWidth)
+}
+
+func (s *sketch) add(key string) {
+	for i := 0; i < sketchDepth; i++ {
+		if c := &s.counts[i][s.index(key, i)]; *c < sketchMax {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= sketchWidth*10 {
+		for i := range s.counts {
+			for j := range s.counts[i] {
+				s.counts[i][j] /= 2
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	n := uint8(sketchMax)
+	for i := 0; i < sketchDepth; i++ {
+		if c := s.counts[i][s.index(key, i)]; c < n {
+			n = c
+		}
+	}
+	return n
+}
+
+type tinyLFUPolicy struct {
+	EvictionPolicy
+	freq sketch
+}
+
+// Returns a policy that evicts as p does, but admits a new entry only if it
+// has been requested more often, lately, than the entry it would evict. See
+// Einziger, Friedman and Manes, "TinyLFU: A Highly Efficient Cache Admission
+// Policy".
+func NewTinyLFUPolicy(p EvictionPolicy) EvictionPolicy {
+	return &tinyLFUPolicy{EvictionPolicy: p}
+}
+
+func (p *tinyLFUPolicy) Touch(key string) {
+	p.freq.add(key)
+	p.EvictionPolicy.Touch(key)
+}
+
+func (p *tinyLFUPolicy) Admit(key string, size int, victim string) bool {
+	if p.freq.estimate(key) <= p.freq.estimate(victim) {
+		return false
+	}
+	return p.EvictionPolicy.Admit(key, size, victim)
+}
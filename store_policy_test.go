@@ -0,0 +1,83 @@
+package httpc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEntrySize(t *testing.T) {
+	s := NewMemoryStore(20)
+	s.Set("a", map[string]string{"Etag": "xyzzy"}, []byte("body"))
+	if used := s.(*memoryStore).usedBytes; used != 14 {
+		t.Errorf("expected 14 bytes used, got %d", used)
+	}
+	s.Set("b", map[string]string{"Etag": "xyzzy"}, []byte("body"))
+	if info, _ := s.Get("a"); info != nil {
+		t.Error("expected a evicted to make room for b's info")
+	}
+}
+
+func TestGreedyDualSize(t *testing.T) {
+	s := NewMemoryStorePolicy(90, NewGreedyDualSizePolicy)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		s.Set(key, map[string]string{}, []byte("small"))
+	}
+	s.Set("big", map[string]string{}, []byte(strings.Repeat("x", 60)))
+	s.Set("e", map[string]string{}, []byte("small"))
+
+	// The big entry goes first, rather than the oldest small ones.
+	if info, _ := s.Get("big"); info != nil {
+		t.Error("expected big evicted")
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if info, _ := s.Get(key); info == nil {
+			t.Errorf("expected %s kept", key)
+		}
+	}
+}
+
+func TestTinyLFU(t *testing.T) {
+	newPolicy := func() EvictionPolicy { return NewTinyLFUPolicy(NewLRUPolicy()) }
+	s := NewMemoryStorePolicy(11, newPolicy)
+	s.Set("a", map[string]string{}, []byte("body1"))
+	for i := 0; i < 3; i++ {
+		s.Get("a")
+	}
+
+	// b is new, and less popular than a, so it stays out.
+	s.Get("b")
+	s.Set("b", map[string]string{}, []byte("body2"))
+	if info, _ := s.Get("b"); info != nil {
+		t.Error("expected b not admitted")
+	}
+	if info, _ := s.Get("a"); info == nil {
+		t.Error("expected a kept")
+	}
+
+	// Once c has been asked for more often than a, it gets in.
+	for i := 0; i < 6; i++ {
+		s.Get("c")
+	}
+	s.Set("c", map[string]string{}, []byte("body3"))
+	if info, _ := s.Get("c"); info == nil {
+		t.Error("expected c admitted")
+	}
+	if info, _ := s.Get("a"); info != nil {
+		t.Error("expected a evicted")
+	}
+}
+
+// Replacing an entry, as a revalidation does, needn't win admission again.
+func TestTinyLFUReplace(t *testing.T) {
+	newPolicy := func() EvictionPolicy { return NewTinyLFUPolicy(NewLRUPolicy()) }
+	s := NewMemoryStorePolicy(12, newPolicy)
+	s.Set("a", map[string]string{}, []byte("body1"))
+	s.Set("b", map[string]string{}, []byte("body2"))
+	for i := 0; i < 5; i++ {
+		s.Get("a")
+	}
+	s.Set("b", map[string]string{}, []byte("body22"))
+	if info, _ := s.Get("b"); info == nil {
+		t.Error("expected b replaced, got nil")
+	}
+}
@@ -0,0 +1,93 @@
+package httpc
+
+import (
+	"io"
+	"os"
+)
+
+type tieredStore []Store
+
+// Stores responses in each of tiers, fastest first, such as a small
+// NewMemoryStore in front of a large NewFileStore. Writes go to every tier.
+// An entry found in a lower tier is copied into the tiers above it as it is
+// read.
+func NewTieredStore(tiers ...Store) Store {
+	s := make(tieredStore, len(tiers))
+	copy(s, tiers)
+	return s
+}
+
+func (s tieredStore) Get(key string) (map[string]string, io.ReadCloser) {
+	for i, tier := range s {
+		info, content := tier.Get(key)
+		if info == nil {
+			continue
+		}
+		if i > 0 {
+			content = &tee{rc: content, w: s[0:i].Create(key, info)}
+		}
+		return info, content
+	}
+	return nil, nil
+}
+
+func (s tieredStore) Set(key string, info map[string]string, content []byte) {
+	for _, tier := range s {
+		tier.Set(key, info, content)
+	}
+}
+
+func (s tieredStore) Delete(key string) {
+	for _, tier := range s {
+		tier.Delete(key)
+	}
+}
+
+func (s tieredStore) Create(key string, info map[string]string) StoreWriter {
+	w := make(multiWriter, len(s))
+	for i, tier := range s {
+		w[i] = tier.Create(key, info)
+	}
+	return w
+}
+
+// Writes to several StoreWriters at once. A writer that fails is aborted and
+// dropped, leaving the rest to carry on, so that an entry too big for one tier
+// still reaches the others.
+type multiWriter []StoreWriter
+
+func (w multiWriter) Write(p []byte) (int, os.Error) {
+	var err os.Error = errTooBig
+	for i, sw := range w {
+		if sw == nil {
+			continue
+		}
+		if _, werr := sw.Write(p); werr != nil {
+			sw.Abort()
+			w[i] = nil
+			continue
+		}
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w multiWriter) Commit() {
+	for _, sw := range w {
+		if sw != nil {
+			sw.Commit()
+		}
+	}
+}
+
+func (w multiWriter) Abort() {
+	for i, sw := range w {
+		if sw != nil {
+			sw.Abort()
+			w[i] = nil
+		}
+	}
+}
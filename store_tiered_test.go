@@ -0,0 +1,77 @@
+package httpc
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTieredWriteThrough(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	mem := NewMemoryStore(1000)
+	disk := NewFileStore(dir, 1000)
+	s := NewTieredStore(mem, disk)
+
+	s.Set("a", map[string]string{}, []byte("body"))
+	wantContent(t, mem, "a", "body")
+	wantContent(t, disk, "a", "body")
+
+	w := s.Create("b", map[string]string{})
+	w.Write([]byte("body"))
+	w.Commit()
+	wantContent(t, mem, "b", "body")
+	wantContent(t, disk, "b", "body")
+
+	s.Delete("a")
+	wantMissing(t, mem, "a")
+	wantMissing(t, disk, "a")
+}
+
+func TestTieredPromote(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	mem := NewMemoryStore(1000)
+	disk := NewFileStore(dir, 1000)
+	s := NewTieredStore(mem, disk)
+
+	disk.Set("a", map[string]string{"Etag": "x"}, []byte("body"))
+	wantMissing(t, mem, "a")
+	wantContent(t, s, "a", "body")
+	info, _ := mem.Get("a")
+	if info == nil || info["Etag"] != "x" {
+		t.Errorf("expected a promoted with its info, got %#v", info)
+	}
+	wantContent(t, mem, "a", "body")
+
+	// A read cut short still promotes the whole entry.
+	disk.Set("b", map[string]string{}, []byte("body"))
+	_, content := s.Get("b")
+	content.Read(make([]byte, 2))
+	content.Close()
+	wantContent(t, mem, "b", "body")
+}
+
+// An entry too big for the memory tier still goes to disk.
+func TestTieredTooBig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	mem := NewMemoryStore(10)
+	disk := NewFileStore(dir, 1000)
+	s := NewTieredStore(mem, disk)
+
+	body := "long body that doesn't fit"
+	w := s.Create("a", map[string]string{})
+	if _, err := w.Write([]byte(body)); err != nil {
+		t.Error("unexpected err", err)
+	}
+	w.Commit()
+	wantMissing(t, mem, "a")
+	wantContent(t, disk, "a", body)
+
+	_, content := s.Get("a")
+	if x, _ := ioutil.ReadAll(content); string(x) != body {
+		t.Errorf("expected body %#v, got %#v", body, string(x))
+	}
+	content.Close()
+}
@@ -0,0 +1,254 @@
+package httpc
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Reports whether s is a valid URL scheme (RFC 3986, section 3.1).
+func validScheme(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Splits a URL reference into its five components (RFC 3986, section 3).
+// The delimiters are not included. An empty query or fragment is treated as
+// if it were absent.
+func splitURL(s string) (scheme, authority, path, query, fragment string) {
+	if i := strings.Index(s, "#"); i >= 0 {
+		s, fragment = s[0:i], s[i+1:]
+	}
+	if i := strings.Index(s, "?"); i >= 0 {
+		s, query = s[0:i], s[i+1:]
+	}
+	if i := strings.Index(s, ":"); i > 0 && validScheme(s[0:i]) {
+		scheme, s = s[0:i], s[i+1:]
+	}
+	if strings.HasPrefix(s, "//") {
+		s = s[2:]
+		i := strings.Index(s, "/")
+		if i < 0 {
+			i = len(s)
+		}
+		authority, s = s[0:i], s[i:]
+	}
+	return scheme, authority, s, query, fragment
+}
+
+// The inverse of splitURL.
+func joinURL(scheme, authority, path, query, fragment string) string {
+	s := ""
+	if scheme != "" {
+		s += scheme + ":"
+	}
+	if authority != "" {
+		s += "//" + authority
+	}
+	s += path
+	if query != "" {
+		s += "?" + query
+	}
+	if fragment != "" {
+		s += "#" + fragment
+	}
+	return s
+}
+
+// Removes "." and ".." segments from a path (RFC 3986, section 5.2.4).
+func removeDotSegments(in string) string {
+	out := ""
+	trimLast := func() {
+		if i := strings.LastIndex(out, "/"); i >= 0 {
+			out = out[0:i]
+		} else {
+			out = ""
+		}
+	}
+	for in != "" {
+		switch {
+		case strings.HasPrefix(in, "../"):
+			in = in[3:]
+		case strings.HasPrefix(in, "./"):
+			in = in[2:]
+		case strings.HasPrefix(in, "/./"):
+			in = in[2:]
+		case in == "/.":
+			in = "/"
+		case strings.HasPrefix(in, "/../"):
+			in = in[3:]
+			trimLast()
+		case in == "/..":
+			in = "/"
+			trimLast()
+		case in == "." || in == "..":
+			in = ""
+		default:
+			i := strings.Index(in[1:], "/")
+			if i < 0 {
+				out += in
+				in = ""
+			} else {
+				out += in[0 : i+1]
+				in = in[i+1:]
+			}
+		}
+	}
+	return out
+}
+
+// Resolves a URL reference, such as the value of a Location header, against
+// an absolute base URL (RFC 3986, section 5.2).
+func resolveURL(base, ref string) string {
+	scheme, authority, path, query, fragment := splitURL(ref)
+	if scheme != "" {
+		return joinURL(scheme, authority, removeDotSegments(path), query, fragment)
+	}
+
+	bscheme, bauthority, bpath, bquery, _ := splitURL(base)
+	if strings.HasPrefix(ref, "//") {
+		return joinURL(bscheme, authority, removeDotSegments(path), query, fragment)
+	}
+	if path == "" {
+		if query == "" {
+			query = bquery
+		}
+		return joinURL(bscheme, bauthority, bpath, query, fragment)
+	}
+	if path[0] != '/' {
+		if bauthority != "" && bpath == "" {
+			path = "/" + path
+		} else {
+			path = bpath[0:strings.LastIndex(bpath, "/")+1] + path
+		}
+	}
+	return joinURL(bscheme, bauthority, removeDotSegments(path), query, fragment)
+}
+
+// Returns the scheme and authority of url, in lower case, for comparing
+// origins.
+func urlOrigin(url string) string {
+	scheme, authority, _, _, _ := splitURL(url)
+	return strings.ToLower(scheme + "://" + authority)
+}
+
+// Ports that can be left out of a URL with the given scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Normalizes a URL so that URLs that are equivalent under RFC 3986, section
+// 6, compare equal. The scheme and host are lower-cased, a default port is
+// removed, percent-encoding is normalized, dot-segments are removed, an
+// empty path becomes "/", and the fragment is dropped. If sortQuery is true,
+// query parameters are also sorted, which most servers, but not all, treat as
+// equivalent.
+func NormalizeURL(url string, sortQuery bool) string {
+	scheme, authority, path, query, _ := splitURL(url)
+	scheme = strings.ToLower(scheme)
+
+	if authority != "" {
+		userinfo, host := "", authority
+		if i := strings.LastIndex(host, "@"); i >= 0 {
+			userinfo, host = host[0:i+1], host[i+1:]
+		}
+		host = strings.ToLower(host)
+		if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+			if port := host[i+1:]; port == "" || port == defaultPorts[scheme] {
+				host = host[0:i]
+			}
+		}
+		authority = userinfo + normPercent(host)
+		if path == "" {
+			path = "/"
+		}
+	}
+	path = normPercent(path)
+	if scheme != "" || authority != "" {
+		path = removeDotSegments(path)
+	}
+
+	query = normPercent(query)
+	if sortQuery && query != "" {
+		params := splitString(query, '&')
+		sort.SortStrings(params)
+		query = strings.Join(params, "&")
+	}
+	return joinURL(scheme, authority, path, query, "")
+}
+
+func normURL(url string) string {
+	return NormalizeURL(url, false)
+}
+
+// Splits s around each instance of sep.
+func splitString(s string, sep byte) []string {
+	a := make([]string, strings.Count(s, string(sep))+1)
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep {
+			a[n] = s[0:i]
+			n++
+			s = s[i+1:]
+			i = -1
+		}
+	}
+	a[n] = s
+	return a
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// Reports whether c is an unreserved character, which never needs
+// percent-encoding (RFC 3986, section 2.3).
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// Normalizes percent-encoding: decodes unreserved characters and upper-cases
+// the hex digits of everything else (RFC 3986, section 6.2.2).
+func normPercent(s string) string {
+	if strings.Index(s, "%") < 0 {
+		return s
+	}
+	const hex = "0123456789ABCDEF"
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if unreserved(c) {
+				buf.WriteByte(c)
+			} else {
+				buf.WriteByte('%')
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&15])
+			}
+			i += 2
+			continue
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,66 @@
+package httpc
+
+import (
+	"testing"
+)
+
+// From RFC 3986, section 5.4.
+var resolveTests = []struct {
+	ref, want string
+}{
+	{"g:h", "g:h"},
+	{"g", "http://a/b/c/g"},
+	{"./g", "http://a/b/c/g"},
+	{"g/", "http://a/b/c/g/"},
+	{"/g", "http://a/g"},
+	{"//g", "http://g"},
+	{"?y", "http://a/b/c/d;p?y"},
+	{"g?y", "http://a/b/c/g?y"},
+	{"#s", "http://a/b/c/d;p?q#s"},
+	{"g#s", "http://a/b/c/g#s"},
+	{";x", "http://a/b/c/;x"},
+	{"", "http://a/b/c/d;p?q"},
+	{".", "http://a/b/c/"},
+	{"..", "http://a/b/"},
+	{"../g", "http://a/b/g"},
+	{"../..", "http://a/"},
+	{"../../g", "http://a/g"},
+	{"../../../g", "http://a/g"},
+	{"/./g", "http://a/g"},
+	{"g.", "http://a/b/c/g."},
+	{"./../g", "http://a/b/g"},
+	{"g/../h", "http://a/b/c/h"},
+	{"g;x=1/./y", "http://a/b/c/g;x=1/y"},
+}
+
+func TestResolveURL(t *testing.T) {
+	base := "http://a/b/c/d;p?q"
+	for _, rt := range resolveTests {
+		if got := resolveURL(base, rt.ref); got != rt.want {
+			t.Errorf("resolveURL(%q) = %q, want %q", rt.ref, got, rt.want)
+		}
+	}
+}
+
+var normalizeTests = []struct {
+	url       string
+	sortQuery bool
+	want      string
+}{
+	{"http://example.com:8080/a", false, "http://example.com:8080/a"},
+	{"HTTPS://Example.COM:443/%7euser/%2fx/./a/../b?q=%7e#frag", false, "https://example.com/~user/%2Fx/b?q=~"},
+	{"http://host:", false, "http://host/"},
+	{"http://User@Host/", false, "http://User@host/"},
+	{"http://[::1]:80/", false, "http://[::1]/"},
+	{"http://a/?b=2&a=1", false, "http://a/?b=2&a=1"},
+	{"http://a/?b=2&a=1", true, "http://a/?a=1&b=2"},
+	{"/", false, "/"},
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for _, nt := range normalizeTests {
+		if got := NormalizeURL(nt.url, nt.sortQuery); got != nt.want {
+			t.Errorf("NormalizeURL(%q, %v) = %q, want %q", nt.url, nt.sortQuery, got, nt.want)
+		}
+	}
+}